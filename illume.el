@@ -2,9 +2,15 @@
 
 (defun illume-stop ()
   (interactive)
-  (when illume-process
-    (ignore-errors (kill-process illume-process))
-    (setf illume-process nil)))
+  (let ((process illume-process))
+    (setf illume-process nil)
+    (when (process-live-p process)
+      ;; Let it finish the transcript before anything else writes to
+      ;; the buffer, but do not wait forever.
+      (ignore-errors (interrupt-process process))
+      (with-timeout (5 (ignore-errors (kill-process process)))
+        (while (process-live-p process)
+          (accept-process-output process 0.1))))))
 
 (defun illume ()
   (interactive)
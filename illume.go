@@ -3,16 +3,37 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	fp "path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -94,7 +115,7 @@ var Profiles = map[string][]string{
 		"!api \"https://api.anthropic.com/v1/messages\"",
 		"!>anthropic-version 2023-06-01",
 		"!>x-api-key $ANTHROPIC_API_KEY",
-        "!:model claude-sonnet-4-5",
+		"!:model claude-sonnet-4-5",
 		"!:max_tokens 10000",
 	},
 	"claude-extended": []string{
@@ -322,9 +343,72 @@ func emitgithub(w *bytes.Buffer, paths []string) error {
 	return nil
 }
 
+// Importer embeds external content, such as a discussion thread, into
+// the conversation. The arguments are the rest of the directive line.
+type Importer interface {
+	Import(w *bytes.Buffer, args string) error
+}
+
+// ImporterFunc adapts an ordinary function into an Importer.
+type ImporterFunc func(w *bytes.Buffer, args string) error
+
+func (f ImporterFunc) Import(w *bytes.Buffer, args string) error {
+	return f(w, args)
+}
+
+// Importers maps "!NAME" directives to their importer. Anything not listed
+// here is available through "!import NAME" as an external program.
+var Importers = map[string]Importer{
+	"reddit": ImporterFunc(func(w *bytes.Buffer, args string) error {
+		return emitreddit(w, strings.TrimSpace(args), true)
+	}),
+	"reddit!": ImporterFunc(func(w *bytes.Buffer, args string) error {
+		return emitreddit(w, strings.TrimSpace(args), false)
+	}),
+	"github": ImporterFunc(func(w *bytes.Buffer, args string) error {
+		return emitgithub(w, strings.Fields(args))
+	}),
+}
+
+// ExternalImporter runs "illume-import-NAME ARGS..." from $PATH and embeds
+// its standard output.
+type ExternalImporter string
+
+func (e ExternalImporter) Import(w *bytes.Buffer, args string) error {
+	name := "illume-import-" + string(e)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, strings.Fields(args)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if _, ok := err.(*exec.ExitError); ok && msg != "" {
+			return fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return err
+	}
+
+	out := stdout.Bytes()
+	w.Write(out)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		w.WriteByte('\n')
+	}
+	return nil
+}
+
+// Find the importer for a name, falling back on an external program.
+func importer(name string) Importer {
+	if imp, ok := Importers[name]; ok {
+		return imp
+	}
+	return ExternalImporter(name)
+}
+
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	Branch  int    `json:"-"` // alternative number within its group
+	Group   int    `json:"-"` // group of alternatives, 0 for none
 }
 
 type Choice struct {
@@ -334,20 +418,25 @@ type Choice struct {
 type Response struct {
 	Content string
 	Choices []struct {
+		Index int
 		Text  string
 		Delta struct {
 			Content string
 		}
 	}
 	Delta struct { // Anthropic
-		Text     string
-		Thinking string
+		Text        string
+		Thinking    string
+		PartialJson string `json:"partial_json"`
 	}
 }
 
 type Builder struct {
 	Messages []Message
 	Role     string
+	Branch   int         // alternative number of the message being built
+	Groups   int         // groups of alternatives so far
+	Chosen   map[int]int // selected alternative per group
 	Content  bytes.Buffer
 }
 
@@ -362,14 +451,77 @@ func (b *Builder) New(role string) []Message {
 		if b.Role == "" {
 			b.Role = "system"
 		}
-		b.Messages = append(b.Messages, Message{b.Role, content})
+		m := Message{Role: b.Role, Content: content}
+		if b.Branch > 0 {
+			m.Branch = b.Branch
+			m.Group = b.Groups
+		}
+		b.Messages = append(b.Messages, m)
 	}
 	b.Role = role
+	b.Branch = 0
 	b.Content = bytes.Buffer{}
 	if len(b.Messages) == 0 {
 		return []Message{}
 	}
-	return b.Messages
+	return b.Selected()
+}
+
+// Fork is like New, but the new message is alternative n among a group of
+// consecutive alternatives, such as "!assistant #2".
+func (b *Builder) Fork(role string, n int) {
+	continued := b.Branch > 0
+	b.New(role)
+	if !continued {
+		b.Groups++
+	}
+	b.Branch = n
+}
+
+// Choose selects which alternative of the latest group is forwarded.
+func (b *Builder) Choose(n int) error {
+	if b.Groups == 0 {
+		return fmt.Errorf("no alternatives to choose from")
+	}
+	if b.Chosen == nil {
+		b.Chosen = map[int]int{}
+	}
+	b.Chosen[b.Groups] = n
+	return nil
+}
+
+// Selected returns the conversation along the chosen path, keeping one
+// alternative from each group: the chosen one, otherwise the first.
+// Rubrics are not part of the conversation.
+func (b *Builder) Selected() []Message {
+	messages := []Message{}
+	seen := map[int]bool{}
+	for _, m := range b.Messages {
+		if m.Role == "rubric" {
+			continue
+		} else if m.Group > 0 {
+			choice, ok := b.Chosen[m.Group]
+			if (ok && m.Branch != choice) || (!ok && seen[m.Group]) {
+				continue
+			}
+			seen[m.Group] = true
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// Parse the "#N" alternative marker from !assistant arguments, if any.
+func branchof(args string) int {
+	for _, field := range strings.Fields(args) {
+		if len(field) > 1 && field[0] == '#' {
+			n, err := strconv.Atoi(field[1:])
+			if err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 0
 }
 
 func cut(s string, b byte) (string, string, bool) {
@@ -434,17 +586,52 @@ type ChatState struct {
 	Exclude   string
 	Builder   Builder
 	Data      map[string]interface{}
-	UserSet   map[string]bool
+	Layer     int            // layer of the directives being loaded
+	Layers    map[string]int // layer that last changed each setting
+	Vars      map[string]string
+	Loaded    map[string]bool
+	Isolated  bool // ignore !profile directives, for !compare
+	Origins   map[string]string
+	Appends   []appended // "!:KEY+" values, applied by Request
+	Includes  int
 	Headers   map[string]string
 	Type      int
+	Samples   int
+	Compare   []string
+	Judge     string
+	Label     string
+	Timeout   time.Duration
+	Connect   time.Duration
+	Idle      time.Duration
+	Tls       *tls.Config
+	Proxy     func(*http.Request) (*url.URL, error)
+	SecretCmd string
+	Schema    interface{}
+	Secrets   map[string]string
 	Debug     bool
+	Explain   bool
+	Raw       bool
 	Stats     bool
 	Excluding bool
 	GptOss    bool
 }
 
+// Layers of configuration in increasing precedence. A directive does
+// not change a setting last changed by a higher layer, and so within a
+// layer the last directive wins.
+const (
+	LayerDefault = iota
+	LayerEnv     // $ILLUME_PROFILE, or else the default profile
+	LayerProfile // profiles loaded explicitly
+	LayerUser    // the input itself
+	LayerFlags   // command line flags
+)
+
 const (
 	InvalidUrl = "http://invalid./"
+
+	// Limit on nested profiles and includes, which may recurse
+	MaxDepth = 16
 )
 
 func NewChatState() *ChatState {
@@ -453,7 +640,10 @@ func NewChatState() *ChatState {
 		Data: map[string]interface{}{
 			"max_tokens": 2000,
 		},
-		UserSet: map[string]bool{},
+		Layers:  map[string]int{},
+		Vars:    map[string]string{},
+		Loaded:  map[string]bool{},
+		Origins: map[string]string{},
 		Type:    TypeChat,
 		Headers: map[string]string{
 			"content-type": "application/json",
@@ -462,7 +652,84 @@ func NewChatState() *ChatState {
 	return s
 }
 
+// Directories searched in order for NAME.profile files: $ILLUME_PATH,
+// the configuration directory, the nearest .illume directory from the
+// working directory up, and next to the executable. The user's own
+// directories come first so a checked out project cannot shadow them.
+func profiledirs() []string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("ILLUME_PATH")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	if dir := configdir(); dir != "" {
+		dirs = append(dirs, dir)
+	}
+
+	if dir, err := os.Getwd(); err == nil {
+		for {
+			local := filepath.Join(dir, ".illume")
+			if info, err := os.Stat(local); err == nil && info.IsDir() {
+				dirs = append(dirs, local)
+				break
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	return dirs
+}
+
+// Find the file for a named profile, or the empty string.
+func findprofile(profile string) string {
+	for _, dir := range profiledirs() {
+		candidate := path.Join(dir, profile+".profile")
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// List every available profile by name, with where it resolves from.
+func listprofiles(w io.Writer) error {
+	var names []string
+	source := map[string]string{}
+	for name := range Profiles {
+		names = append(names, name)
+		source[name] = "built-in"
+	}
+	for _, dir := range profiledirs() {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.profile"))
+		for _, match := range matches {
+			name := strings.TrimSuffix(filepath.Base(match), ".profile")
+			if _, ok := source[name]; !ok {
+				names = append(names, name)
+				source[name] = match
+			}
+		}
+	}
+	sort.Strings(names)
+
+	b := bufio.NewWriter(w)
+	for _, name := range names {
+		fmt.Fprintf(b, "%-24s %s\n", name, source[name])
+	}
+	return b.Flush()
+}
+
 func (s *ChatState) LoadProfile(profile string, depth int) error {
+	if depth >= MaxDepth {
+		return fmt.Errorf("!profile: too deeply nested: %s", profile)
+	}
+
 	var body string
 	if lines, ok := Profiles[profile]; ok {
 		var buf bytes.Buffer
@@ -479,24 +746,74 @@ func (s *ChatState) LoadProfile(profile string, depth int) error {
 				return err // do not search
 			}
 
-			// Search for *.profile next to the executable
-			exe, exeerr := os.Executable()
-			if exeerr != nil {
+			// Search for *.profile in the profile directories
+			relpath := findprofile(profile)
+			if relpath == "" {
 				return err // search fail: return original error
 			}
-			relpath := path.Join(filepath.Dir(exe), profile+".profile")
 			relbuf, relerr := ioutil.ReadFile(relpath)
 			if relerr != nil {
-				return err // search fail: return original error
+				return relerr
 			}
 			buf = relbuf
 		}
 		body = string(buf)
 	}
 	s.Profile = profile
+	s.Loaded[profile] = true
+
+	// Profiles loaded by the default profile stay in its layer
+	layer := s.Layer
+	if layer != LayerEnv {
+		s.Layer = LayerProfile
+	}
+	defer func() { s.Layer = layer }()
 	return s.Load(profile, body, depth+1) // may recurse
 }
 
+// Load $ILLUME_PROFILE, or otherwise the default profile, beneath any
+// explicitly loaded profiles.
+func (s *ChatState) LoadDefaultProfile() error {
+	profile := os.Getenv("ILLUME_PROFILE")
+	if profile == "" {
+		profile = DefaultProfile
+	}
+	layer := s.Layer
+	s.Layer = LayerEnv
+	defer func() { s.Layer = layer }()
+	return s.LoadProfile(profile, 0)
+}
+
+// Built-in llama.cpp grammars for !grammar NAME, in GBNF.
+var Grammars = map[string][]string{
+	"json": []string{
+		`root   ::= object`,
+		`value  ::= (object | array | string | number |`,
+		`  ("true" | "false" | "null") ws)`,
+		`object ::= "{" ws (`,
+		`  string ":" ws value ("," ws string ":" ws value)*`,
+		`)? "}" ws`,
+		`array  ::= "[" ws (value ("," ws value)*)? "]" ws`,
+		`string ::= "\"" (`,
+		`  [^"\\\x7F\x00-\x1F] |`,
+		`  "\\" (["\\/bfnrt] | "u" [0-9a-fA-F]{4})`,
+		`)* "\"" ws`,
+		`number ::= ("-"? ([0-9] | [1-9] [0-9]{0,15})`,
+		`  ("." [0-9]+)? ([eE] [-+]? [0-9]{1,3})?) ws`,
+		`ws     ::= | " " | "\n" [ \t]{0,20}`,
+	},
+	"yes-no": []string{
+		`root ::= "yes" | "no"`,
+	},
+
+	// A single fenced code block with an optional language tag
+	"code-block": []string{
+		"root ::= \"```\" [a-zA-Z0-9_+-]* \"\\n\" line* \"```\"",
+		"line ::= ([^`\\n] [^\\n]* | \"`\" [^`\\n] [^\\n]* | " +
+			"\"``\" [^`\\n] [^\\n]*)? \"\\n\"",
+	},
+}
+
 const (
 	TagNone = iota
 	TagOpen
@@ -518,9 +835,119 @@ func tagmatch(s string, tag string) int {
 	return TagNone
 }
 
+// Report whether a name is usable as a template variable.
+func varname(name string) bool {
+	for i, r := range name {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Expand {{NAME}} in a line of input from variables, and {{env:NAME}}
+// from the environment. Unknown names are left as is, and "\{{" is a
+// literal "{{". Inserted content, such as from !context, is never
+// expanded.
+func (s *ChatState) expand(line string) string {
+	if !strings.Contains(line, "{{") {
+		return line
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(line, "{{")
+		if i < 0 {
+			break
+		}
+		if i > 0 && line[i-1] == '\\' {
+			b.WriteString(line[:i-1])
+			b.WriteString("{{")
+			line = line[i+2:]
+			continue
+		}
+		b.WriteString(line[:i])
+		line = line[i:]
+
+		j := strings.Index(line, "}}")
+		if j < 0 {
+			break
+		}
+		name := strings.TrimSpace(line[2:j])
+		var value string
+		var ok bool
+		if env := strings.TrimPrefix(name, "env:"); env != name {
+			if varname(env) {
+				value, ok = os.LookupEnv(env)
+			}
+		} else if varname(name) {
+			value, ok = s.Vars[name]
+		}
+		if !ok {
+			value = line[:j+2]
+		}
+		b.WriteString(value)
+		line = line[j+2:]
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// Find a file by relative path in the current directory, then in each
+// directory listed in $ILLUME_PATH.
+func search(file string) (string, error) {
+	_, err := os.Stat(file)
+	if err == nil || filepath.IsAbs(file) {
+		return file, err
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("ILLUME_PATH")) {
+		if dir == "" {
+			continue
+		}
+		candidate := filepath.Join(dir, file)
+		if _, staterr := os.Stat(candidate); staterr == nil {
+			return candidate, nil
+		}
+	}
+	return "", err // search fail: return original error
+}
+
+// Splice a file into the input at the current position, as though its
+// contents were written in place.
+func (s *ChatState) include(file string, depth int) error {
+	if file == "" {
+		return fmt.Errorf("!include: missing file name")
+	}
+	if s.Includes >= MaxDepth {
+		return fmt.Errorf("!include: too deeply nested: %s", file)
+	}
+
+	path, err := search(file)
+	if err != nil {
+		return fmt.Errorf("!include: %w", err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("!include: %w", err)
+	}
+
+	s.Includes++
+	defer func() { s.Includes-- }()
+	return s.Load(path, string(buf), depth)
+}
+
+// An open !if block in ChatState.Load.
+type conditional struct {
+	lineno int
+	value  bool
+	inelse bool
+}
+
 func (s *ChatState) Load(name, txt string, depth int) error {
-	lineno := 1
-	for line, lines := txt, txt; len(lines) > 0; lineno++ {
+	var conds []conditional
+	lineno, skip := 1, 0
+	for line, lines := txt, txt; len(lines) > 0; lineno += 1 + skip {
+		skip = 0
 		line, lines, _ = cut(lines, '\n')
 		command, args, _ := cut(line, ' ')
 
@@ -535,18 +962,101 @@ func (s *ChatState) Load(name, txt string, depth int) error {
 			}
 		}
 
-		if strings.HasPrefix(line, "!!") {
+		// A directive value may instead follow as a heredoc. Errors
+		// still report the directive's line. The body is consumed even
+		// in an inactive branch so its lines are not read as input.
+		inline := false
+		if prefix, tag := heredoctag(command, args); tag != "" {
+			var ok bool
+			args, lines, skip, ok = heredoc(lines, tag)
+			if !ok {
+				err := fmt.Errorf("%s: missing %s terminator", command, tag)
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			args = prefix + args
+			inline = true
+		}
+
+		active := true
+		for _, c := range conds {
+			active = active && c.value
+		}
+
+		if command == "!if" {
+			value := false
+			if active {
+				var err error
+				if value, err = s.condition(args); err != nil {
+					err := fmt.Errorf("!if: %w", err)
+					return fmt.Errorf("%s:%d: %w", name, lineno, err)
+				}
+			}
+			conds = append(conds, conditional{lineno, value, false})
+			continue
+
+		} else if command == "!else" {
+			if len(conds) == 0 || conds[len(conds)-1].inelse {
+				err := fmt.Errorf("!else: no matching !if")
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			c := &conds[len(conds)-1]
+			c.value = !c.value
+			c.inelse = true
+			continue
+
+		} else if command == "!endif" {
+			if len(conds) == 0 {
+				err := fmt.Errorf("!endif: no matching !if")
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			conds = conds[:len(conds)-1]
+			continue
+
+		} else if !active {
+			continue
+
+		} else if strings.HasPrefix(line, "!!") {
 			line = line[1:] // escape "!!" as "!"
 
 		} else if command == "!profile" {
+			if s.Isolated {
+				continue
+			}
 			profile := strings.TrimSpace(args)
 			if err := s.LoadProfile(profile, depth); err != nil {
 				return fmt.Errorf("%s:%d: %w", name, lineno, err)
 			}
 			continue
 
+		} else if command == "!include" {
+			if err := s.include(strings.TrimSpace(args), depth); err != nil {
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			continue
+
 		} else if command == "!debug" {
 			s.Debug = true
+			s.Raw = strings.TrimSpace(args) == "raw"
+			continue
+
+		} else if command == "!set" {
+			key, value, _ := cut(strings.TrimSpace(args), ' ')
+			if key == "" {
+				err := fmt.Errorf("!set: missing variable name")
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			if !s.claim("!set "+key, at(name, lineno)) {
+				continue
+			}
+			if value = strings.TrimSpace(value); value == "" {
+				delete(s.Vars, key)
+			} else {
+				s.Vars[key] = value
+			}
+			continue
+
+		} else if command == "!explain" {
+			s.Explain = true
 			continue
 
 		} else if command == "!stats" {
@@ -554,10 +1064,41 @@ func (s *ChatState) Load(name, txt string, depth int) error {
 			continue
 
 		} else if command == "!prepend" {
-			if len(args) > 1 && args[0] == '"' {
+			if !inline && len(args) > 1 && args[0] == '"' {
 				json.Unmarshal(([]byte)(args), &args)
 			}
-			s.Prepend = args
+			if s.claim(command, at(name, lineno)) {
+				s.Prepend = args
+			}
+			continue
+
+		} else if command == "!samples" {
+			n, err := strconv.Atoi(strings.TrimSpace(args))
+			if err != nil || n < 1 {
+				err := fmt.Errorf("!samples: invalid count: %q", args)
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			s.Samples = n
+			continue
+
+		} else if command == "!compare" {
+			s.Compare = strings.Fields(args)
+			if len(s.Compare) == 0 {
+				err := fmt.Errorf("!compare: no profiles given")
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			continue
+
+		} else if command == "!judge" {
+			s.Judge = strings.TrimSpace(args)
+			if s.Judge == "" {
+				err := fmt.Errorf("!judge: no profile given")
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			continue
+
+		} else if command == "!rubric" {
+			s.Builder.New("rubric")
 			continue
 
 		} else if command == "!completion" {
@@ -570,23 +1111,22 @@ func (s *ChatState) Load(name, txt string, depth int) error {
 			}
 			continue
 
-		} else if command == "!reddit" {
-			path := strings.TrimSpace(args)
-			if err := emitreddit(&s.Builder.Content, path, true); err != nil {
+		} else if command == "!import" {
+			kind, args, _ := cut(strings.TrimSpace(args), ' ')
+			if kind == "" {
+				err := fmt.Errorf("!import: missing importer name")
 				return fmt.Errorf("%s:%d: %w", name, lineno, err)
 			}
-			continue
-
-		} else if command == "!reddit!" {
-			path := strings.TrimSpace(args)
-			if err := emitreddit(&s.Builder.Content, path, false); err != nil {
+			err := importer(kind).Import(&s.Builder.Content, args)
+			if err != nil {
 				return fmt.Errorf("%s:%d: %w", name, lineno, err)
 			}
 			continue
 
-		} else if command == "!github" {
-			args := strings.Fields(line)[1:]
-			if err := emitgithub(&s.Builder.Content, args); err != nil {
+		} else if len(command) > 1 && command[0] == '!' &&
+			Importers[command[1:]] != nil {
+			err := Importers[command[1:]].Import(&s.Builder.Content, args)
+			if err != nil {
 				return fmt.Errorf("%s:%d: %w", name, lineno, err)
 			}
 			continue
@@ -600,7 +1140,9 @@ func (s *ChatState) Load(name, txt string, depth int) error {
 			continue
 
 		} else if command == "!exclude" {
-			s.Exclude = strings.TrimSpace(args)
+			if s.claim(command, at(name, lineno)) {
+				s.Exclude = strings.TrimSpace(args)
+			}
 			continue
 
 		} else if command == "!begin" {
@@ -608,16 +1150,122 @@ func (s *ChatState) Load(name, txt string, depth int) error {
 			continue
 
 		} else if command == "!end" {
+			conds = nil // the rest is ignored
 			break
 
+		} else if command == "!timeout" || command == "!connect-timeout" ||
+			command == "!idle-timeout" {
+			d, err := parseduration(args)
+			if err != nil {
+				err := fmt.Errorf("%s: %w", command, err)
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			var setting *time.Duration
+			switch command {
+			case "!timeout":
+				setting = &s.Timeout
+			case "!connect-timeout":
+				setting = &s.Connect
+			case "!idle-timeout":
+				setting = &s.Idle
+			}
+			if s.claim(command, at(name, lineno)) {
+				*setting = d
+			}
+			continue
+
+		} else if command == "!tls-ca" || command == "!tls-cert" ||
+			command == "!tls-insecure" || command == "!proxy" {
+			// Certificates add up within a layer, but those of a higher
+			// layer replace any from lower layers
+			layer, ok := s.Layers[command]
+			if !s.claim(command, at(name, lineno)) {
+				continue
+			}
+			if ok && layer < s.Layer && s.Tls != nil {
+				switch command {
+				case "!tls-ca":
+					s.Tls.RootCAs = nil
+				case "!tls-cert":
+					s.Tls.Certificates = nil
+				}
+			}
+			if err := s.connection(command, args); err != nil {
+				err := fmt.Errorf("%s: %w", command, err)
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			continue
+
+		} else if command == "!secret-command" {
+			// Only the user's own configuration may run a command, not
+			// whichever conversation happens to be loaded
+			if s.Layer == LayerUser {
+				err := fmt.Errorf("%s: only allowed in a profile", command)
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
+			if s.claim(command, at(name, lineno)) {
+				s.SecretCmd = strings.TrimSpace(args)
+			}
+			continue
+
+		} else if command == "!schema" {
+			if s.claim(command, at(name, lineno)) {
+				schema, err := loadschema(strings.TrimSpace(args))
+				if err != nil {
+					err := fmt.Errorf("!schema: %w", err)
+					return fmt.Errorf("%s:%d: %w", name, lineno, err)
+				}
+				s.Schema = schema
+			}
+			continue
+
+		} else if command == "!grammar" {
+			var grammar string
+			if inline {
+				grammar = args + "\n"
+			} else if g, ok := Grammars[strings.TrimSpace(args)]; ok {
+				grammar = strings.Join(g, "\n") + "\n"
+			} else if path := strings.TrimSpace(args); path != "" {
+				buf, err := ioutil.ReadFile(path)
+				if err != nil {
+					err := fmt.Errorf("!grammar: %w", err)
+					return fmt.Errorf("%s:%d: %w", name, lineno, err)
+				}
+				grammar = string(buf)
+			}
+
+			// Same precedence as !:grammar
+			if grammar == "" {
+				s.unsetkey("grammar", at(name, lineno))
+			} else {
+				s.setkey("grammar", grammar, at(name, lineno))
+			}
+			continue
+
 		} else if command == "!api" {
-			if s.Api == InvalidUrl || depth == 0 {
+			if s.claim(command, at(name, lineno)) {
 				s.Api = strings.TrimSpace(args)
 			}
 			continue
 
 		} else if command == "!assistant" || command == "!user" {
-			s.Builder.New(command[1:])
+			if n := branchof(args); n > 0 && command == "!assistant" {
+				s.Builder.Fork("assistant", n)
+			} else {
+				s.Builder.New(command[1:])
+			}
+			continue
+
+		} else if command == "!choose" {
+			n, err := strconv.Atoi(strings.TrimSpace(args))
+			if err != nil || n < 1 {
+				err = fmt.Errorf("!choose: invalid alternative: %q", args)
+			} else if err = s.Builder.Choose(n); err != nil {
+				err = fmt.Errorf("!choose: %w", err)
+			}
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
+			}
 			continue
 
 		} else if command == "!infill" {
@@ -628,13 +1276,17 @@ func (s *ChatState) Load(name, txt string, depth int) error {
 					s.Type = TypeInfill
 				}
 				s.Builder.New("infill")
-			} else {
+			} else if s.claim(command, at(name, lineno)) {
 				s.FimTmpl = args
 			}
 			continue
 
 		} else if len(command) > 2 && command[:2] == "!>" {
-			key := command[2:]
+			// Header names are case-insensitive, so keep one spelling
+			key := strings.ToLower(command[2:])
+			if !s.claim("!>"+key, at(name, lineno)) {
+				continue
+			}
 			args = strings.TrimSpace(args)
 			if args == "" {
 				delete(s.Headers, key)
@@ -645,82 +1297,342 @@ func (s *ChatState) Load(name, txt string, depth int) error {
 
 		} else if len(command) > 2 && command[:2] == "!:" {
 			key := command[2:]
-			if depth > 0 {
-				if hard, ok := s.UserSet[key]; ok && hard {
-					continue // do not override
-				}
+			appending := strings.HasSuffix(key, "+")
+			key = strings.TrimSuffix(key, "+")
+			if key == "" || strings.Contains("."+key+".", "..") {
+				err := fmt.Errorf("%s: invalid key path", command)
+				return fmt.Errorf("%s:%d: %w", name, lineno, err)
 			}
 
 			args = strings.TrimSpace(args)
 			if args == "" {
-				delete(s.Data, key)
+				s.unsetkey(key, at(name, lineno))
 			} else {
 				var value interface{}
 				err := json.Unmarshal(([]byte)(args), &value)
 				if err != nil {
-					s.Data[key] = args
+					value = args
+				}
+				if appending {
+					a := appended{key, value, s.Layer, at(name, lineno)}
+					s.Appends = append(s.Appends, a)
 				} else {
-					s.Data[key] = value
+					s.setkey(key, value, at(name, lineno))
 				}
 			}
-			s.UserSet[key] = depth == 0
 			continue
 		}
 
+		// Only text the user writes is a template, not replies
+		switch s.Builder.Role {
+		case "", "system", "user":
+			line = s.expand(line)
+		}
 		s.Builder.Append(line)
 	}
 
+	if len(conds) > 0 {
+		err := fmt.Errorf("!if: missing !endif")
+		return fmt.Errorf("%s:%d: %w", name, conds[len(conds)-1].lineno, err)
+	}
 	return nil
 }
 
-func query(txt string) error {
-	var (
-		client http.Client
-		state  = NewChatState()
-	)
-
-	if err := state.Load("<stdin>", txt, 0); err != nil {
-		return err
+// Look up a value by a dotted key path into nested objects.
+func lookup(data map[string]interface{}, key string) (interface{}, bool) {
+	path := strings.Split(key, ".")
+	for _, name := range path[:len(path)-1] {
+		var ok bool
+		if data, ok = data[name].(map[string]interface{}); !ok {
+			return nil, false
+		}
 	}
+	value, ok := data[path[len(path)-1]]
+	return value, ok
+}
 
-	if state.Profile == "" {
-		// No profile loaded yet. Load one now.
-		profile := os.Getenv("ILLUME_PROFILE")
-		if profile == "" {
-			profile = DefaultProfile
-		}
-		if err := state.LoadProfile(profile, 1); err != nil {
-			return err
+// Store a value at a dotted key path, creating or replacing objects
+// along the way as needed.
+func store(data map[string]interface{}, key string, value interface{}) {
+	path := strings.Split(key, ".")
+	for _, name := range path[:len(path)-1] {
+		next, ok := data[name].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			data[name] = next
 		}
+		data = next
 	}
+	data[path[len(path)-1]] = value
+}
 
-	api, err := interpolate(state.Api, state.Data)
-	if err != nil {
-		return fmt.Errorf("interpolating URL: %w", err)
+// Append to the array at a dotted key path. A missing value is an empty
+// array, a non-array value becomes the first element, and array values
+// are concatenated.
+func appendvalue(
+	data map[string]interface{},
+	key string,
+	value interface{},
+) []interface{} {
+	var result []interface{}
+	switch current, _ := lookup(data, key); current := current.(type) {
+	case nil:
+	case []interface{}:
+		result = append(result, current...)
+	default:
+		result = append(result, current)
 	}
+	if values, ok := value.([]interface{}); ok {
+		return append(result, values...)
+	}
+	return append(result, value)
+}
 
-	strictapi := false
-	if len(api) > 2 && api[0] == '"' && api[len(api)-1] == '"' {
-		api = api[1 : len(api)-1]
-		strictapi = true
+// Report whether a layer may change a setting: unless a higher layer
+// changed it, or for a key path, an object containing it.
+func (s *ChatState) settable(key string, layer int) bool {
+	for {
+		if s.Layers[key] > layer {
+			return false
+		}
+		i := strings.LastIndexByte(key, '.')
+		if i < 0 || key[0] == '!' {
+			return true
+		}
+		key = key[:i]
 	}
+}
 
-	if !strictapi && !strings.HasSuffix(api, "/") {
-		api += "/"
+// Take over a setting for the layer being loaded, noting where, if the
+// layer may change it.
+func (s *ChatState) claim(key, at string) bool {
+	if !s.settable(key, s.Layer) {
+		return false // do not override
 	}
+	s.Layers[key] = s.Layer
+	s.Origins[key] = at
+	s.replaced(key)
+	return true
+}
 
-	switch state.Type {
-	case TypeChat:
-		if !strictapi {
-			api += "chat/completions"
+// Collect the values within an object at a key path set by a higher
+// layer, which survive replacing the object, and forget the others.
+func (s *ChatState) within(key string) map[string]interface{} {
+	kept := map[string]interface{}{}
+	for k, layer := range s.Layers {
+		if strings.HasPrefix(k, key+".") {
+			v, ok := lookup(s.Data, k)
+			if ok && layer > s.Layer {
+				kept[k] = v
+			} else {
+				delete(s.Layers, k)
+				delete(s.Origins, k)
+			}
 		}
-		state.Data["messages"] = state.Builder.New("")
+	}
+	return kept
+}
+
+// A value appended to the array at a key path by "!:KEY+". Appends are
+// held until all layers are loaded, so that they extend the final value
+// rather than a value a lower layer would otherwise set later.
+type appended struct {
+	key   string
+	value interface{}
+	layer int
+	at    string
+}
+
+// Forget appends to a setting, or within it, from the layer being loaded
+// or those below, since the setting now replaces them.
+func (s *ChatState) replaced(key string) {
+	kept := s.Appends[:0]
+	for _, a := range s.Appends {
+		within := a.key == key || strings.HasPrefix(a.key, key+".")
+		if !within || a.layer > s.Layer {
+			kept = append(kept, a)
+		}
+	}
+	s.Appends = kept
+}
+
+// Apply the held appends in order of layer, skipping those to a setting
+// since changed by a higher layer.
+func (s *ChatState) applyappends() {
+	sort.SliceStable(s.Appends, func(i, j int) bool {
+		return s.Appends[i].layer < s.Appends[j].layer
+	})
+	for _, a := range s.Appends {
+		if !s.settable(a.key, a.layer) {
+			continue
+		}
+		store(s.Data, a.key, appendvalue(s.Data, a.key, a.value))
+		if at, ok := s.Origins[a.key]; ok {
+			s.Origins[a.key] = at + ", " + a.at
+		} else {
+			s.Origins[a.key] = a.at
+		}
+	}
+	s.Appends = nil
+}
+
+// Set a dotted key path in the request data, subject to layering.
+func (s *ChatState) setkey(key string, value interface{}, at string) {
+	if s.claim(key, at) {
+		kept := s.within(key)
+		store(s.Data, key, value)
+		for k, v := range kept {
+			store(s.Data, k, v)
+		}
+	}
+}
+
+// Remove a dotted key path from the request data, subject to layering.
+func (s *ChatState) unsetkey(key, at string) {
+	if !s.claim(key, at) {
+		return
+	}
+	kept := s.within(key)
+	i := strings.LastIndexByte(key, '.')
+	if i < 0 {
+		delete(s.Data, key)
+	} else if value, ok := lookup(s.Data, key[:i]); ok {
+		if parent, ok := value.(map[string]interface{}); ok {
+			delete(parent, key[i+1:])
+		}
+	}
+	for k, v := range kept {
+		store(s.Data, k, v)
+	}
+}
+
+// Evaluate an !if condition: env:VAR, var:NAME, key:PATH, or
+// profile:NAME. Variables and keys are true when set and non-empty, or
+// with =VALUE when equal to VALUE. A profile is true once loaded. A
+// leading "!" negates the condition.
+func (s *ChatState) condition(expr string) (bool, error) {
+	expr = strings.TrimSpace(expr)
+	negate := strings.HasPrefix(expr, "!")
+	expr = strings.TrimPrefix(expr, "!")
+	kind, name, _ := cut(expr, ':')
+	name, want, compare := cut(name, '=')
+	if name == "" {
+		return false, fmt.Errorf("invalid condition: %q", expr)
+	}
+
+	var value string
+	switch kind {
+	case "env":
+		value = os.Getenv(name)
+	case "var":
+		value = s.Vars[name]
+	case "key":
+		v, _ := lookup(s.Data, name)
+		if str, ok := v.(string); ok {
+			value = str
+		} else if v != nil {
+			b, _ := marshal(v)
+			value = string(b)
+		}
+	case "profile":
+		if compare {
+			return false, fmt.Errorf("invalid condition: %q", expr)
+		}
+		return s.Loaded[name] != negate, nil
+	default:
+		return false, fmt.Errorf("unknown condition: %q", expr)
+	}
+
+	if compare {
+		return (value == want) != negate, nil
+	}
+	return (value != "") != negate, nil
+}
+
+// Report whether a directive sets a value, and so may take a heredoc.
+// Other lines, such as !user or an unknown "!shell", keep "<<" as text.
+func valued(command string) bool {
+	switch command {
+	case "!api", "!exclude", "!grammar", "!infill", "!prepend", "!proxy",
+		"!schema", "!secret-command", "!set",
+		"!timeout", "!connect-timeout", "!idle-timeout":
+		return true
+	}
+	return len(command) > 2 && (command[:2] == "!:" || command[:2] == "!>")
+}
+
+// Return the terminator tag if a directive's value is given as a
+// heredoc, "!directive [ARGS] <<TAG", otherwise the empty string. Also
+// returns the arguments preceding the value.
+func heredoctag(command, args string) (string, string) {
+	if !valued(command) {
+		return "", ""
+	}
+	args = strings.TrimSpace(args)
+	i := strings.LastIndexByte(args, ' ') + 1
+	prefix, word := args[:i], args[i:]
+	if !strings.HasPrefix(word, "<<") || len(word) == 2 {
+		return "", ""
+	}
+	for _, r := range word[2:] {
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return "", ""
+		}
+	}
+	return prefix, word[2:]
+}
+
+// Collect lines up to a line consisting only of the terminator tag,
+// returning the body, the remaining input, and the number of lines
+// consumed including the terminator.
+func heredoc(lines, tag string) (string, string, int, bool) {
+	var body []string
+	for n := 1; len(lines) > 0; n++ {
+		var line string
+		line, lines, _ = cut(lines, '\n')
+		if strings.TrimRight(line, "\r") == tag {
+			return strings.Join(body, "\n"), lines, n, true
+		}
+		body = append(body, line)
+	}
+	return "", "", 0, false
+}
+
+// Request builds the final API URL and request body from the loaded
+// state, completing the query object for the selected mode.
+func (s *ChatState) Request() (string, []byte, error) {
+	s.applyappends()
+
+	api, err := interpolate(s.Api, s.Data)
+	if err != nil {
+		return "", nil, fmt.Errorf("interpolating URL: %w", err)
+	}
+
+	strictapi := false
+	if len(api) > 2 && api[0] == '"' && api[len(api)-1] == '"' {
+		api = api[1 : len(api)-1]
+		strictapi = true
+	}
+
+	if strings.HasPrefix(api, "unix://") && !strings.Contains(api[7:], ":") {
+		api += ":/" // socket without a path
+	}
+	if !strictapi && !strings.HasSuffix(api, "/") {
+		api += "/"
+	}
+
+	switch s.Type {
+	case TypeChat:
+		if !strictapi {
+			api += "chat/completions"
+		}
+		s.Data["messages"] = s.Builder.New("")
 
 	case TypeCompletion:
 		if !strictapi {
 			api += "completions"
 		}
-		state.Data["prompt"] = state.Builder.New("")[0].Content
+		s.Data["prompt"] = s.Builder.New("")[0].Content
 
 	case TypeInfill:
 		// llama.cpp only
@@ -735,19 +1647,19 @@ func query(txt string) error {
 		// examples, and maybe predicting fewer would help. Though in my
 		// experiments, predicting few didn't make a difference.
 
-		state.Data["prompt"] = "" // prompt is required
+		s.Data["prompt"] = "" // prompt is required
 
 		// TODO: Consider trimming prefix/suffix? Maybe to a certain
 		// number of lines to the nearest blank line. Otherwise this
 		// will not work well on large source files. On the other hand
 		// it might lose critical context. A smarter tool would crush
 		// the context down to just declarations/prototypes.
-		parts := state.Builder.New("")
-		state.Data["input_prefix"] = parts[0].Content + "\n"
+		parts := s.Builder.New("")
+		s.Data["input_prefix"] = parts[0].Content + "\n"
 		if len(parts) > 1 {
-			state.Data["input_suffix"] = "\n" + parts[1].Content
+			s.Data["input_suffix"] = "\n" + parts[1].Content
 		} else {
-			state.Data["input_suffix"] = ""
+			s.Data["input_suffix"] = ""
 		}
 
 	case TypeFim:
@@ -755,7 +1667,7 @@ func query(txt string) error {
 			api += "completions"
 		}
 
-		parts := state.Builder.New("")
+		parts := s.Builder.New("")
 		vars := map[string]interface{}{
 			"prefix": parts[0].Content + "\n",
 			"suffix": "",
@@ -764,175 +1676,1795 @@ func query(txt string) error {
 			vars["suffix"] = "\n" + parts[1].Content
 		}
 
-		state.Data["prompt"], err = interpolate(state.FimTmpl, vars)
+		s.Data["prompt"], err = interpolate(s.FimTmpl, vars)
 		if err != nil {
-			return fmt.Errorf("!infill: %w", err)
+			return "", nil, fmt.Errorf("!infill: %w", err)
 		}
 	}
 
-	state.Data["stream"] = true
-	body, _ := marshal(state.Data)
+	if s.Schema != nil {
+		s.structured()
+	}
 
-	if state.Debug {
-		w := bufio.NewWriter(os.Stdout)
-		fmt.Fprintf(w, "\n\nPOST %s HTTP/1.1\n", api)
-		for key, value := range state.Headers {
-			fmt.Fprintf(w, "%s: %s\n", key, value)
+	for key, value := range s.Headers {
+		if s.Headers[key], err = s.expandsecrets(value); err != nil {
+			return "", nil, fmt.Errorf("!>%s: %w", key, err)
 		}
-		fmt.Fprintf(w, "\n%s\n", body)
-		return w.Flush()
 	}
 
-	req, err := http.NewRequest("POST", api, bytes.NewBuffer(body))
+	s.Data["stream"] = true
+	body, _ := marshal(s.Data)
+	return api, body, nil
+}
+
+// Read a JSON Schema from a file.
+func loadschema(path string) (interface{}, error) {
+	buf, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	var schema interface{}
+	if err := json.Unmarshal(buf, &schema); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return schema, nil
+}
 
-	for key, value := range state.Headers {
-		req.Header.Set(key, value)
+// Request structured output in the form each kind of API expects. Keys
+// set explicitly take precedence.
+func (s *ChatState) structured() {
+	setdefault := func(key string, value interface{}) {
+		if _, ok := s.Data[key]; !ok {
+			s.Data[key] = value
+			s.Origins[key] = s.Origins["!schema"]
+		}
 	}
 
-	time_start := time.Now()
-	resp, err := client.Do(req)
-	time_response := time.Now()
-	if err != nil {
-		return err
+	switch {
+	case s.Headers["anthropic-version"] != "":
+		// Force a call to a tool whose input is the response
+		setdefault("tools", []interface{}{
+			map[string]interface{}{
+				"name":         "response",
+				"description":  "Respond with structured output.",
+				"input_schema": s.Schema,
+			},
+		})
+		setdefault("tool_choice", map[string]interface{}{
+			"type": "tool",
+			"name": "response",
+		})
+
+	case s.Type == TypeChat:
+		setdefault("response_format", map[string]interface{}{
+			"type": "json_schema",
+			"json_schema": map[string]interface{}{
+				"name":   "response",
+				"strict": true,
+				"schema": s.Schema,
+			},
+		})
+
+	default: // llama.cpp
+		setdefault("json_schema", s.Schema)
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != 200 {
-		ebody, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(ebody))
+// Check a structured reply against the schema, skipping over reasoning
+// in leading <think> tags.
+func (s *ChatState) conforms(reply []byte) error {
+	text := strings.TrimSpace(string(reply))
+	if strings.HasPrefix(text, "<think>") {
+		if i := strings.Index(text, "</think>"); i >= 0 {
+			text = strings.TrimSpace(text[i+8:])
+		}
 	}
 
-	w := bufio.NewWriter(os.Stdout)
-	if state.Type == TypeChat {
-		w.WriteString("\n\n!assistant\n\n")
-		w.WriteString(state.Prepend)
-		w.Flush()
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return fmt.Errorf("!schema: reply is not JSON: %w", err)
 	}
 
-	const (
-		GptInit = iota
-		GptName
-		GptMessage
-		GptStart
-		GptRole
-	)
-	gptstate := GptInit
-	gptname := ""
+	var errs []string
+	validate(s.Schema, s.Schema, value, "$", &errs)
+	if len(errs) > 0 {
+		return fmt.Errorf(
+			"!schema: reply does not conform:\n%s",
+			strings.Join(errs, "\n"),
+		)
+	}
+	return nil
+}
 
-	nthinking := 0
-	nevents := 0
-	s := bufio.NewScanner(resp.Body)
-	for s.Scan() {
-		line := s.Bytes()
-		if !bytes.HasPrefix(line, []byte("data: ")) {
-			continue
+// Name the JSON type of a decoded value.
+func jsontype(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
 		}
-		line = line[6:]
-		if bytes.Equal(line, []byte("[DONE]")) {
-			break
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// Find the schema referenced by a local "#/..." JSON pointer.
+func resolveref(root interface{}, ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref: %s", ref)
+	}
+	node := root
+	for _, part := range strings.Split(ref[1:], "/")[1:] {
+		part = strings.Replace(part, "~1", "/", -1)
+		part = strings.Replace(part, "~0", "~", -1)
+		m, ok := node.(map[string]interface{})
+		if !ok || m[part] == nil {
+			return nil, fmt.Errorf("unresolved $ref: %s", ref)
 		}
+		node = m[part]
+	}
+	return node, nil
+}
 
-		var r Response
-		json.Unmarshal(line, &r)
+// Validate a decoded JSON value against a JSON Schema, appending each
+// violation to errs with its path. Covers the commonly used keywords,
+// and $ref within the root schema.
+func validate(root, schema, value interface{}, path string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
 
-		// Response schemas are all over the place. Try reading from
-		// three different schemas at once. Missing fields are likely
-		// empty strings, and so produce no output.
-		if len(r.Choices) > 0 {
-			chat := r.Choices[0].Delta.Content
-			if len(chat) > 0 {
-				// Assumes llama.cpp sends one token at at time, which is the
-				// only way think tokens could be processed unambigously.
-				if state.GptOss && chat == "<|channel|>" {
-					gptstate = GptName
-				} else if gptstate == GptName {
-					gptname = chat
-					gptstate = GptMessage
-				} else if gptstate == GptMessage {
-					if chat != "<|message|>" {
-						w.WriteString("<|channel|>")
-						w.WriteString(gptname)
-						w.WriteString(chat)
-					} else {
-						switch gptname {
-						case "analysis":
-							w.WriteString("<think>\n")
-						case "final":
-							w.WriteString("\n</think>\n\n")
-						}
-					}
-					gptstate = GptInit
-				} else if state.GptOss && chat == "<|end|>" {
-					gptstate = GptStart
-				} else if state.GptOss && chat == "<|start|>" {
-					gptstate = GptRole
-				} else if gptstate == GptRole {
-					// drop role name ("assistant")
-					gptstate = GptInit
+	sch, ok := schema.(map[string]interface{})
+	if !ok {
+		if allowed, ok := schema.(bool); ok && !allowed {
+			fail("not allowed")
+		}
+		return
+	}
+
+	if ref, ok := sch["$ref"].(string); ok {
+		target, err := resolveref(root, ref)
+		if err != nil {
+			fail("%v", err)
+			return
+		}
+		validate(root, target, value, path, errs)
+	}
+
+	if t, ok := sch["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, e := range t {
+				if e, ok := e.(string); ok {
+					types = append(types, e)
+				}
+			}
+		}
+		actual := jsontype(value)
+		matched := false
+		for _, t := range types {
+			matched = matched || t == actual ||
+				(t == "number" && actual == "integer")
+		}
+		if !matched {
+			fail("expected %s, got %s", strings.Join(types, " or "), actual)
+			return
+		}
+	}
+
+	if enum, ok := sch["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, value)
+		}
+		if !found {
+			fail("not one of the allowed values")
+		}
+	}
+	if c, ok := sch["const"]; ok && !reflect.DeepEqual(c, value) {
+		fail("not the required constant value")
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		required, _ := sch["required"].([]interface{})
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, ok := v[name]; !ok {
+					fail("missing required property %q", name)
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		props, _ := sch["properties"].(map[string]interface{})
+		for _, key := range keys {
+			child := path + "." + key
+			if prop, ok := props[key]; ok {
+				validate(root, prop, v[key], child, errs)
+			} else if extra, ok := sch["additionalProperties"]; ok {
+				if allowed, ok := extra.(bool); ok && !allowed {
+					*errs = append(*errs, child+": unexpected property")
 				} else {
-					w.WriteString(chat)
+					validate(root, extra, v[key], child, errs)
 				}
+			}
+		}
 
-			} else {
-				w.WriteString(r.Choices[0].Text)
+	case []interface{}:
+		if min, ok := sch["minItems"].(float64); ok && float64(len(v)) < min {
+			fail("fewer than %v items", min)
+		}
+		if max, ok := sch["maxItems"].(float64); ok && float64(len(v)) > max {
+			fail("more than %v items", max)
+		}
+		if items, ok := sch["items"]; ok {
+			for i, e := range v {
+				child := fmt.Sprintf("%s[%d]", path, i)
+				validate(root, items, e, child, errs)
 			}
+		}
 
-		} else if len(r.Delta.Thinking) > 0 { // Anthropic
-			if nthinking == 0 {
-				w.WriteString("<think>\n")
+	case string:
+		n := float64(utf8.RuneCountInString(v))
+		if min, ok := sch["minLength"].(float64); ok && n < min {
+			fail("shorter than %v characters", min)
+		}
+		if max, ok := sch["maxLength"].(float64); ok && n > max {
+			fail("longer than %v characters", max)
+		}
+		if pattern, ok := sch["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err == nil && !re.MatchString(v) {
+				fail("does not match pattern %q", pattern)
 			}
-			nthinking++
-			w.WriteString(r.Delta.Thinking)
+		}
 
-		} else if len(r.Delta.Text) > 0 { // Anthropic
-			if nthinking > 0 {
-				w.WriteString("\n</think>\n\n")
-				nthinking = 0
+	case float64:
+		if min, ok := sch["minimum"].(float64); ok && v < min {
+			fail("less than %v", min)
+		}
+		if max, ok := sch["maximum"].(float64); ok && v > max {
+			fail("greater than %v", max)
+		}
+		if min, ok := sch["exclusiveMinimum"].(float64); ok && v <= min {
+			fail("not greater than %v", min)
+		}
+		if max, ok := sch["exclusiveMaximum"].(float64); ok && v >= max {
+			fail("not less than %v", max)
+		}
+	}
+
+	if all, ok := sch["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			validate(root, sub, value, path, errs)
+		}
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		options, ok := sch[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		matches := 0
+		for _, sub := range options {
+			var suberrs []string
+			validate(root, sub, value, path, &suberrs)
+			if len(suberrs) == 0 {
+				matches++
 			}
-			w.WriteString(r.Delta.Text)
+		}
+		if matches == 0 {
+			fail("matches none of %s", keyword)
+		} else if keyword == "oneOf" && matches > 1 {
+			fail("matches more than one of oneOf")
+		}
+	}
+}
 
-		} else {
-			w.WriteString(r.Content) // completion
+// Directory for Illume's configuration files, e.g. ~/.config/illume.
+func configdir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return fp.Join(dir, "illume")
+}
+
+// Replace "{secret:NAME}" references with their secret values.
+func (s *ChatState) expandsecrets(value string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(value, "{secret:")
+		if i < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		j := strings.IndexByte(value[i:], '}')
+		if j < 0 {
+			return "", fmt.Errorf("unmatched '{'")
 		}
 
-		w.Flush()
-		nevents++
+		name := value[i+8 : i+j]
+		secret, err := s.secret(name)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", name, err)
+		}
+		b.WriteString(value[:i])
+		b.WriteString(secret)
+		value = value[i+j+1:]
 	}
-	if err := s.Err(); err != nil {
-		return err
+}
+
+// Look up a secret from the !secret-command helper when configured,
+// otherwise from the secrets file, then netrc.
+func (s *ChatState) secret(name string) (string, error) {
+	if secret, ok := s.Secrets[name]; ok {
+		return secret, nil
 	}
-	if err := resp.Body.Close(); err != nil {
-		return err
+
+	var secret string
+	var err error
+	if s.SecretCmd != "" {
+		secret, err = secretcommand(s.SecretCmd, name)
+	} else if secret, err = secretfile(name); err == nil && secret == "" {
+		secret, err = secretnetrc(name)
+		if err == nil && secret == "" {
+			err = fmt.Errorf("not found")
+		}
+	}
+	if err != nil {
+		return "", err
 	}
-	time_done := time.Now()
 
-	if state.Stats {
-		req_time := time_response.Sub(time_start)
-		stream_time := time_done.Sub(time_response)
-		token_rate := float64(nevents) / stream_time.Seconds()
-		fmt.Fprintf(
-			w, "\n\n!note %.3g tok/s, %d toks, %v",
-			token_rate, nevents, req_time,
-		)
+	if s.Secrets == nil {
+		s.Secrets = map[string]string{}
+	}
+	s.Secrets[name] = secret
+	return secret, nil
+}
+
+// Run the secret helper command, substituting the name for "{name}", or
+// appending it as the last argument. The first line of output is the
+// secret.
+func secretcommand(command, name string) (string, error) {
+	args := strings.Fields(command)
+	found := false
+	for i, arg := range args {
+		if strings.Contains(arg, "{name}") {
+			args[i] = strings.Replace(arg, "{name}", name, -1)
+			found = true
+		}
+	}
+	if !found {
+		args = append(args, name)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if _, ok := err.(*exec.ExitError); ok && msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", args[0], err, msg)
+		}
+		return "", err
 	}
 
-	return w.Flush()
+	secret, _, _ := cut(stdout.String(), '\n')
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return "", fmt.Errorf("%s: no output", args[0])
+	}
+	return secret, nil
 }
 
-func run() error {
-	body, err := ioutil.ReadAll(os.Stdin)
+// Look up a secret in the "NAME VALUE" lines of $ILLUME_SECRETS, by
+// default "secrets" in the configuration directory. The file must not be
+// accessible to other users. Returns an empty string if not found.
+func secretfile(name string) (string, error) {
+	path := os.Getenv("ILLUME_SECRETS")
+	if path == "" {
+		dir := configdir()
+		if dir == "" {
+			return "", nil
+		}
+		path = fp.Join(dir, "secrets")
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&077 != 0 {
+		return "", fmt.Errorf("%s: accessible to other users, chmod 600", path)
+	}
+
+	buf, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return "", err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, value, _ := cut(line, ' ')
+		if key == name {
+			return strings.TrimSpace(value), nil
+		}
 	}
-	return query(string(body))
+	return "", nil
 }
 
-func main() {
-	if err := run(); err != nil {
-		fmt.Printf("\n\n!error\n\n%s\n", err)
+// Look up the password for the named machine in $NETRC, by default
+// ~/.netrc. Returns an empty string if not found.
+func secretnetrc(name string) (string, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		path = fp.Join(home, ".netrc")
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	machine := ""
+	tokens := strings.Fields(string(buf))
+	for i := 0; i+1 < len(tokens); i++ {
+		switch tokens[i] {
+		case "default":
+			machine = ""
+		case "machine":
+			i++
+			machine = tokens[i]
+		case "password":
+			i++
+			if machine == name {
+				return tokens[i], nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// Headers whose values are credentials.
+var CredentialHeaders = map[string]bool{
+	"api-key":             true,
+	"authorization":       true,
+	"cookie":              true,
+	"proxy-authorization": true,
+	"x-api-key":           true,
+	"x-goog-api-key":      true,
+}
+
+var (
+	tokenpattern = regexp.MustCompile(
+		`\b(sk-[A-Za-z0-9_-]{16,}|hf_[A-Za-z0-9]{16,}|` +
+			`AIza[A-Za-z0-9_-]{30,}|gh[pousr]_[A-Za-z0-9]{20,}|` +
+			`xox[abprs]-[A-Za-z0-9-]{10,})`,
+	)
+	bearerpattern = regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9._~+/=-]{16,}`)
+)
+
+// Redact credentials from text destined for the transcript: secrets by
+// their reference, the values of credential headers, and anything that
+// looks like an API token. Disabled by "!debug raw".
+func (s *ChatState) redact(text string) string {
+	if s.Raw {
+		return text
+	}
+
+	for name, secret := range s.Secrets {
+		text = strings.Replace(text, secret, "{secret:"+name+"}", -1)
+	}
+
+	for key, value := range s.Headers {
+		if !CredentialHeaders[strings.ToLower(key)] {
+			continue
+		}
+		for _, field := range strings.Fields(value) {
+			switch strings.ToLower(field) {
+			case "basic", "bearer", "digest", "token":
+				continue // authorization scheme
+			}
+			if len(field) >= 8 {
+				text = strings.Replace(text, field, "[redacted]", -1)
+			}
+		}
+	}
+
+	text = tokenpattern.ReplaceAllString(text, "[redacted]")
+	return bearerpattern.ReplaceAllString(text, "${1}[redacted]")
+}
+
+// Parse a duration such as "90s" or "2m", where a plain number is seconds.
+func parseduration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if secs, err := strconv.ParseFloat(s, 64); err == nil && secs >= 0 {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration: %q", s)
+	}
+	return d, nil
+}
+
+// Apply a TLS or proxy directive. File names may reference environment
+// variables.
+func (s *ChatState) connection(command, args string) error {
+	fields := strings.Fields(os.ExpandEnv(args))
+	if s.Tls == nil && command != "!proxy" {
+		s.Tls = &tls.Config{}
+	}
+
+	switch command {
+	case "!tls-ca":
+		if len(fields) != 1 {
+			return fmt.Errorf("expected FILE")
+		}
+		pem, err := ioutil.ReadFile(fields[0])
+		if err != nil {
+			return err
+		}
+		if s.Tls.RootCAs == nil {
+			// Extend, rather than replace, the system's certificates
+			s.Tls.RootCAs, err = x509.SystemCertPool()
+			if err != nil {
+				s.Tls.RootCAs = x509.NewCertPool()
+			}
+		}
+		if !s.Tls.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", fields[0])
+		}
+
+	case "!tls-cert":
+		if len(fields) < 1 || len(fields) > 2 {
+			return fmt.Errorf("expected FILE [KEY]")
+		}
+		key := fields[len(fields)-1] // may be in the same file
+		cert, err := tls.LoadX509KeyPair(fields[0], key)
+		if err != nil {
+			return err
+		}
+		s.Tls.Certificates = append(s.Tls.Certificates, cert)
+
+	case "!tls-insecure":
+		s.Tls.InsecureSkipVerify = true
+
+	case "!proxy":
+		if len(fields) == 0 {
+			s.Proxy = func(*http.Request) (*url.URL, error) {
+				return nil, nil // direct, ignoring the environment
+			}
+			return nil
+		}
+		u, err := url.Parse(fields[0])
+		if err != nil {
+			return err
+		}
+		s.Proxy = http.ProxyURL(u)
+	}
+	return nil
+}
+
+// Split a "unix://SOCKET:/PATH" API URL into its socket and an HTTP URL
+// for the path. Other URLs have no socket.
+func unixurl(api string) (string, string) {
+	if !strings.HasPrefix(api, "unix://") {
+		return "", api
+	}
+	socket, path, _ := cut(api[7:], ':')
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return socket, "http://unix" + path
+}
+
+// client returns an HTTP client configured by the connection directives,
+// dialing the Unix domain socket instead if given.
+func (s *ChatState) client(socket string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := net.Dialer{Timeout: s.Connect, KeepAlive: 30 * time.Second}
+	if s.Connect > 0 {
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = s.Connect
+	}
+	if s.Tls != nil {
+		transport.TLSClientConfig = s.Tls.Clone()
+	}
+	if s.Proxy != nil {
+		transport.Proxy = s.Proxy
+	}
+	if socket != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(
+			ctx context.Context, _, _ string,
+		) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// Number of choices requested per query through the "n" key.
+func (s *ChatState) choices() int {
+	if n, ok := s.Data["n"].(float64); ok && n > 1 {
+		return int(n)
+	}
+	return 1
+}
+
+// Introduce an assistant reply in chat mode. Alternative replies are
+// numbered as branches, starting from 1, and labeled when requested.
+func (s *ChatState) header(w io.Writer, branch int) {
+	if s.Type != TypeChat {
+		return
+	}
+	io.WriteString(w, "\n\n!assistant")
+	if branch > 0 {
+		fmt.Fprintf(w, " #%d", branch)
+	}
+	if s.Label != "" {
+		fmt.Fprintf(w, " (%s)", s.Label)
+	}
+	io.WriteString(w, "\n\n")
+	io.WriteString(w, s.Prepend)
+}
+
+// Format where a directive appeared, for !explain.
+func at(name string, lineno int) string {
+	return fmt.Sprintf("%s:%d", name, lineno)
+}
+
+// Dry run: describe the effective configuration instead of sending the
+// request, noting where each setting came from.
+func (s *ChatState) explain(w io.Writer, api string) error {
+	origin := func(key string) string {
+		if at, ok := s.Origins[key]; ok {
+			return at
+		}
+		return "default"
+	}
+	abbrev := func(value interface{}) string {
+		buf, _ := marshal(value)
+		text := s.redact(strings.TrimSpace(string(buf)))
+		if r := []rune(text); len(r) > 60 {
+			text = string(r[:57]) + "..."
+		}
+		return text
+	}
+
+	b := bufio.NewWriter(w)
+	modes := []string{"chat", "completion", "infill", "fim"}
+	fmt.Fprintf(b, "\n\nmode: %s\n", modes[s.Type])
+	var profiles []string
+	for profile := range s.Loaded {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	fmt.Fprintf(b, "profiles: %s\n", strings.Join(profiles, ", "))
+	fmt.Fprintf(b, "api: %s (%s)\n", api, origin("!api"))
+
+	var keys []string
+	for key := range s.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := s.redact(s.Headers[key])
+		fmt.Fprintf(b, "header %s: %s (%s)\n", key, value, origin("!>"+key))
+	}
+
+	// Keys set whole, and those set within objects, but not those built
+	// from the conversation
+	keys = keys[:0]
+	nested := map[string]bool{}
+	for key := range s.Origins {
+		if i := strings.IndexByte(key, '.'); i > 0 && key[0] != '!' {
+			if _, ok := lookup(s.Data, key); ok {
+				keys = append(keys, key)
+				nested[key[:i]] = true
+			}
+		}
+	}
+	for key := range s.Data {
+		switch key {
+		case "messages", "prompt", "input_prefix", "input_suffix", "stream":
+			continue
+		}
+		if _, ok := s.Origins[key]; ok || !nested[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, _ := lookup(s.Data, key)
+		fmt.Fprintf(b, "key %s: %s (%s)\n", key, abbrev(value), origin(key))
+	}
+	return b.Flush()
+}
+
+// Dry run: write the raw HTTP request instead of sending it.
+func (s *ChatState) debug(w io.Writer, api string, body []byte) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "\n\nPOST %s HTTP/1.1\n", api)
+	for key, value := range s.Headers {
+		fmt.Fprintf(b, "%s: %s\n", key, s.redact(value))
+	}
+	fmt.Fprintf(b, "\n%s\n", s.redact(string(body)))
+	if grammar, ok := s.Data["grammar"].(string); ok {
+		// Escaped in the body, so also show it as written
+		fmt.Fprintf(b, "\n# grammar\n%s\n", strings.TrimRight(grammar, "\n"))
+	}
+	return b.Flush()
+}
+
+const (
+	GptInit = iota
+	GptName
+	GptMessage
+	GptStart
+	GptRole
+)
+
+// decoder converts streamed tokens from one choice into transcript text.
+type decoder struct {
+	w        io.Writer
+	gptoss   bool
+	gptstate int
+	gptname  string
+}
+
+func (d *decoder) token(chat string) {
+	// Assumes llama.cpp sends one token at at time, which is the only
+	// way think tokens could be processed unambigously.
+	if d.gptoss && chat == "<|channel|>" {
+		d.gptstate = GptName
+	} else if d.gptstate == GptName {
+		d.gptname = chat
+		d.gptstate = GptMessage
+	} else if d.gptstate == GptMessage {
+		if chat != "<|message|>" {
+			io.WriteString(d.w, "<|channel|>")
+			io.WriteString(d.w, d.gptname)
+			io.WriteString(d.w, chat)
+		} else {
+			switch d.gptname {
+			case "analysis":
+				io.WriteString(d.w, "<think>\n")
+			case "final":
+				io.WriteString(d.w, "\n</think>\n\n")
+			}
+		}
+		d.gptstate = GptInit
+	} else if d.gptoss && chat == "<|end|>" {
+		d.gptstate = GptStart
+	} else if d.gptoss && chat == "<|start|>" {
+		d.gptstate = GptRole
+	} else if d.gptstate == GptRole {
+		// drop role name ("assistant")
+		d.gptstate = GptInit
+	} else {
+		io.WriteString(d.w, chat)
+	}
+}
+
+// Send a prepared request and stream the reply to w. When the query asks
+// for several choices, each is written as its own branch numbered from
+// branch, with the first choice streamed live and the rest following it.
+func (s *ChatState) reply(
+	ctx context.Context, w io.Writer, api string, body []byte, branch int,
+) (err error) {
+	defer func() {
+		if err != nil && !s.Raw {
+			err = errors.New(s.redact(err.Error()))
+		}
+	}()
+
+	socket, api := unixurl(api)
+	client := s.client(socket)
+
+	// The overall timeout is a deadline, and the idle timeout cancels the
+	// request when nothing has arrived for a while. Both are errors, but
+	// an interrupt from the caller ends the reply normally.
+	parent := ctx
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	var idled int32
+	var idle *time.Timer
+	if s.Idle > 0 {
+		idle = time.AfterFunc(s.Idle, func() {
+			atomic.StoreInt32(&idled, 1)
+			stop()
+		})
+		defer idle.Stop()
+	}
+	wake := func() {
+		if idle != nil {
+			idle.Reset(s.Idle)
+		}
+	}
+	cause := func(err error) error {
+		switch {
+		case atomic.LoadInt32(&idled) == 1:
+			return fmt.Errorf("idle timeout: nothing received for %v", s.Idle)
+		case ctx.Err() == context.DeadlineExceeded:
+			return fmt.Errorf("timeout: reply incomplete after %v", s.Timeout)
+		}
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, "POST", api, bytes.NewBuffer(body),
+	)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range s.Headers {
+		req.Header.Set(key, value)
+	}
+
+	time_start := time.Now()
+	resp, err := client.Do(req)
+	time_response := time.Now()
+	if err != nil && parent.Err() == context.Canceled {
+		_, err := io.WriteString(w, "\n\n!note interrupted\n")
+		return err
+	} else if err != nil {
+		return cause(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		ebody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(ebody))
+	}
+
+	// Structured output is held back until the end to validate it
+	var held bytes.Buffer
+	if s.Schema != nil {
+		final := w
+		w = &held
+		defer func() { final.Write(held.Bytes()) }()
+	}
+
+	n := s.choices()
+	if n > 1 && branch == 0 {
+		branch = 1
+	}
+	out := bufio.NewWriter(w)
+	extra := make([]bytes.Buffer, n-1)
+	decoders := make([]decoder, n)
+	for i := range decoders {
+		decoders[i].gptoss = s.GptOss
+		if i == 0 {
+			decoders[i].w = out
+		} else {
+			decoders[i].w = &extra[i-1]
+		}
+	}
+
+	s.header(out, branch)
+	out.Flush()
+	start := held.Len()
+
+	nthinking := 0
+	nevents := 0
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		wake()
+		line := sc.Bytes()
+		if !bytes.HasPrefix(line, []byte("data: ")) {
+			continue
+		}
+		line = line[6:]
+		if bytes.Equal(line, []byte("[DONE]")) {
+			break
+		}
+
+		var r Response
+		json.Unmarshal(line, &r)
+
+		// Response schemas are all over the place. Try reading from
+		// three different schemas at once. Missing fields are likely
+		// empty strings, and so produce no output.
+		if len(r.Choices) > 0 {
+			for _, c := range r.Choices {
+				d := &decoders[0]
+				if c.Index > 0 && c.Index < n {
+					d = &decoders[c.Index]
+				}
+				if len(c.Delta.Content) > 0 {
+					d.token(c.Delta.Content)
+				} else {
+					io.WriteString(d.w, c.Text)
+				}
+			}
+
+		} else if len(r.Delta.Thinking) > 0 { // Anthropic
+			if nthinking == 0 {
+				out.WriteString("<think>\n")
+			}
+			nthinking++
+			out.WriteString(r.Delta.Thinking)
+
+		} else if len(r.Delta.Text) > 0 { // Anthropic
+			if nthinking > 0 {
+				out.WriteString("\n</think>\n\n")
+				nthinking = 0
+			}
+			out.WriteString(r.Delta.Text)
+
+		} else if len(r.Delta.PartialJson) > 0 { // Anthropic tool input
+			out.WriteString(r.Delta.PartialJson)
+
+		} else {
+			out.WriteString(r.Content) // completion
+		}
+
+		out.Flush()
+		nevents++
+	}
+	// An interrupt cuts the reply short, but it's otherwise complete
+	interrupted := parent.Err() == context.Canceled
+	if err := sc.Err(); err != nil && !interrupted {
+		out.Flush()
+		return cause(err)
+	}
+	if err := resp.Body.Close(); err != nil && !interrupted {
+		return cause(err)
+	}
+	time_done := time.Now()
+	out.Flush()
+	end := held.Len()
+
+	if s.Type == TypeChat {
+		for i := range extra {
+			s.header(out, branch+1+i)
+			out.Write(extra[i].Bytes())
+		}
+	}
+
+	if s.Stats {
+		req_time := time_response.Sub(time_start)
+		stream_time := time_done.Sub(time_response)
+		token_rate := float64(nevents) / stream_time.Seconds()
+		fmt.Fprintf(
+			out, "\n\n!note %.3g tok/s, %d toks, %v",
+			token_rate, nevents, req_time,
+		)
+	}
+	if interrupted {
+		out.WriteString("\n\n!note interrupted\n")
+	}
+
+	if s.Schema != nil && !interrupted {
+		if err := s.conforms(held.Bytes()[start:end]); err != nil {
+			out.Flush()
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// Run jobs concurrently, each writing a complete reply. The first job
+// streams straight to w, and the others are written in order as soon as
+// the preceding jobs are done. Failures are reported in place.
+func fanout(w io.Writer, jobs []func(io.Writer) error) error {
+	bufs := make([]bytes.Buffer, len(jobs))
+	errs := make([]error, len(jobs))
+	done := make([]chan bool, len(jobs))
+	for i, job := range jobs {
+		done[i] = make(chan bool)
+		var out io.Writer = &bufs[i]
+		if i == 0 {
+			out = w
+		}
+		go func(i int, job func(io.Writer) error, out io.Writer) {
+			errs[i] = job(out)
+			close(done[i])
+		}(i, job, out)
+	}
+
+	nfail := 0
+	for i := range jobs {
+		<-done[i]
+		if _, err := w.Write(bufs[i].Bytes()); err != nil {
+			return err
+		}
+		if errs[i] != nil {
+			nfail++
+			writeerror(w, errs[i])
+		}
+	}
+	if nfail > 0 {
+		return fmt.Errorf("%d of %d requests failed", nfail, len(jobs))
+	}
+	return nil
+}
+
+// Load a conversation along with directives from the command line.
+// Profiles from the command line load first, like a !profile at the top
+// of the conversation. The other flags act as though written at its end,
+// and override it and its profiles. Variables from the command line are
+// set up front, so that the whole conversation may use them.
+func (s *ChatState) LoadInput(name, txt, flags string) error {
+	var profiles, others []string
+	for _, line := range strings.Split(flags, "\n") {
+		if command, _, _ := cut(line, ' '); command == "!profile" {
+			profiles = append(profiles, line)
+		} else {
+			others = append(others, line)
+		}
+	}
+
+	s.Layer = LayerFlags
+	for i, line := range others {
+		if command, args, _ := cut(line, ' '); command == "!set" {
+			key, value, _ := cut(strings.TrimSpace(args), ' ')
+			s.Vars[key] = strings.TrimSpace(value)
+			s.claim("!set "+key, at("<flags>", i+1))
+		}
+	}
+	if err := s.Load("<flags>", strings.Join(profiles, "\n"), 0); err != nil {
+		return err
+	}
+
+	s.Layer = LayerUser
+	if err := s.Load(name, txt, 0); err != nil {
+		return err
+	}
+	s.Layer = LayerFlags
+	return s.Load("<flags>", strings.Join(others, "\n"), 0)
+}
+
+// Send the same conversation to several profiles concurrently, each with
+// its own state, and write each reply as a labeled alternative. Each
+// profile contributes a single reply.
+func compare(
+	ctx context.Context, w io.Writer, name, txt, flags string,
+	profiles []string,
+) error {
+	jobs := make([]func(io.Writer) error, len(profiles))
+	for i, profile := range profiles {
+		branch := i + 1
+		profile := profile
+		jobs[i] = func(w io.Writer) error {
+			// Ignore the conversation's own profiles so that none of
+			// their keys or headers reach another provider
+			state := NewChatState()
+			state.Isolated = true
+			if err := state.LoadInput(name, txt, flags); err != nil {
+				return err
+			}
+			state.Isolated = false
+
+			// The profile decides where the request goes, and with
+			// which credentials, over the conversation and flags
+			for key := range state.Layers {
+				if key == "!api" || strings.HasPrefix(key, "!>") {
+					state.Layers[key] = LayerDefault
+				}
+			}
+			if err := state.LoadProfile(profile, 0); err != nil {
+				return err
+			}
+			state.Label = profile
+			delete(state.Data, "n")
+
+			api, body, err := state.Request()
+			if err != nil {
+				return err
+			}
+			if state.Explain {
+				return state.explain(w, api)
+			}
+			if state.Debug {
+				return state.debug(w, api, body)
+			}
+			return state.reply(ctx, w, api, body, branch)
+		}
+	}
+	return fanout(w, jobs)
+}
+
+const (
+	DefaultRubric = "Correctness first, then helpfulness and clarity."
+
+	JudgeSystem = "You are an impartial judge comparing candidate " +
+		"replies to the same conversation. Rank the candidates from " +
+		"best to worst according to the rubric, briefly justifying " +
+		"each placement. Finish with a single line of the form " +
+		"\"Ranking: #2 > #1 > #3\"."
+)
+
+// Ask the judge profile to rank the latest group of alternatives in the
+// conversation against its rubric, and write the verdict as notes.
+func judge(
+	ctx context.Context, w io.Writer, conv *ChatState, profile string,
+) error {
+	conv.Builder.New("")
+
+	group := 0
+	var rubric []string
+	var candidates []Message
+	for _, m := range conv.Builder.Messages {
+		if m.Role == "rubric" {
+			rubric = append(rubric, m.Content)
+		} else if m.Group > group {
+			group = m.Group
+			candidates = []Message{m}
+		} else if m.Group > 0 && m.Group == group {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) < 2 {
+		return fmt.Errorf("!judge: needs at least two alternatives")
+	}
+	if len(rubric) == 0 {
+		rubric = []string{DefaultRubric}
+	}
+
+	var prompt bytes.Buffer
+	prompt.WriteString("<conversation>\n")
+	for _, m := range conv.Builder.Selected() {
+		if m.Group == group {
+			break
+		}
+		fmt.Fprintf(&prompt, "<%s>\n%s\n</%s>\n", m.Role, m.Content, m.Role)
+	}
+	prompt.WriteString("</conversation>\n\n")
+	for _, m := range candidates {
+		// Labels are withheld so the judge is blind to their source
+		fmt.Fprintf(&prompt, "<candidate id=\"#%d\">\n", m.Branch)
+		fmt.Fprintf(&prompt, "%s\n</candidate>\n\n", m.Content)
+	}
+	fmt.Fprintf(&prompt, "<rubric>\n%s\n</rubric>", strings.Join(rubric, "\n"))
+
+	state := NewChatState()
+	state.Builder.Append(JudgeSystem)
+	state.Builder.New("user")
+	state.Builder.Append(prompt.String())
+	if err := state.LoadProfile(profile, 0); err != nil {
+		return err
+	}
+
+	api, body, err := state.Request()
+	if err != nil {
+		return err
+	}
+	if conv.Explain || state.Explain {
+		return state.explain(w, api)
+	}
+	if conv.Debug || state.Debug {
+		return state.debug(w, api, body)
+	}
+
+	var head, verdict bytes.Buffer
+	state.header(&head, 0)
+	if err := state.reply(ctx, &verdict, api, body, 0); err != nil {
+		return err
+	}
+	text := strings.TrimPrefix(verdict.String(), head.String())
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "\n\n!note judged by %s\n", profile)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		b.WriteString(strings.TrimSpace("!note " + line))
+		b.WriteString("\n")
+	}
+	return b.Flush()
+}
+
+// Run the conversation in txt, named for error messages, and write the
+// reply to w. Flags are directives from the command line.
+func query(ctx context.Context, w io.Writer, name, txt, flags string) error {
+	state := NewChatState()
+	if err := state.LoadInput(name, txt, flags); err != nil {
+		return err
+	}
+
+	if state.Judge != "" {
+		return judge(ctx, w, state, state.Judge)
+	}
+
+	if len(state.Compare) > 0 {
+		return compare(ctx, w, name, txt, flags, state.Compare)
+	}
+
+	if state.Profile == "" {
+		// No profile loaded yet. Load one now.
+		if err := state.LoadDefaultProfile(); err != nil {
+			return err
+		}
+	}
+
+	api, body, err := state.Request()
+	if err != nil {
+		return err
+	}
+
+	if state.Explain {
+		return state.explain(w, api)
+	}
+	if state.Debug {
+		return state.debug(w, api, body)
+	}
+
+	if state.Samples > 1 {
+		if state.Type != TypeChat {
+			return fmt.Errorf("!samples: only available in chat mode")
+		}
+		n := state.choices()
+		jobs := make([]func(io.Writer) error, state.Samples)
+		for i := range jobs {
+			branch := 1 + i*n
+			jobs[i] = func(w io.Writer) error {
+				return state.reply(ctx, w, api, body, branch)
+			}
+		}
+		return fanout(w, jobs)
+	}
+
+	return state.reply(ctx, w, api, body, 0)
+}
+
+// Write an error into the transcript.
+func writeerror(w io.Writer, err error) {
+	fmt.Fprintf(w, "\n\n!error\n\n%s\n", err)
+}
+
+// Reported is an error already written into the transcript.
+type Reported struct {
+	error
+}
+
+// Lock a conversation file for exclusive in-place use by creating a lock
+// file beside it, recording the owner's PID and host. A lock left behind
+// by a process that no longer exists, such as after a crash, is taken
+// over. Returns a function that releases the lock.
+func lockfile(path string) (func(), error) {
+	lock := path + ".lock"
+	host, _ := os.Hostname()
+	for retry := false; ; retry = true {
+		mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		f, err := os.OpenFile(lock, mode, 0666)
+		if os.IsExist(err) && !retry && takeover(lock, host) {
+			continue
+		} else if os.IsExist(err) {
+			return nil, fmt.Errorf(
+				"%s: in use by another Illume process (see %s)",
+				path, lock,
+			)
+		} else if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(f, "%d %s\n", os.Getpid(), host)
+		f.Close()
+		return func() { os.Remove(lock) }, nil
+	}
+}
+
+// Remove a stale lock so that it may be taken over. Removal happens only
+// while holding a second lock, checking again once held, so two processes
+// finding the same stale lock cannot both remove it, nor remove the lock
+// the other has since created in its place.
+func takeover(lock, host string) bool {
+	if !stalelock(lock, host) {
+		return false
+	}
+	guard := lock + ".takeover"
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	f, err := os.OpenFile(guard, mode, 0666)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	defer os.Remove(guard)
+	return stalelock(lock, host) && os.Remove(lock) == nil
+}
+
+// Report whether a lock file was left behind by a process on this host
+// that no longer exists.
+func stalelock(lock, host string) bool {
+	info, err := os.Stat(lock)
+	if err != nil {
+		return false
+	}
+	buf, err := ioutil.ReadFile(lock)
+	if err != nil {
+		return false
+	}
+
+	var pid int
+	var owner string
+	if n, _ := fmt.Sscan(string(buf), &pid, &owner); n == 0 {
+		// Unreadable, perhaps killed before writing its owner
+		return time.Since(info.ModTime()) > time.Minute
+	}
+	if owner != "" && owner != host {
+		return false // cannot tell from here
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return true
+	} else if runtime.GOOS == "windows" {
+		return false // found, so it exists
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err != nil && !errors.Is(err, syscall.EPERM)
+}
+
+// Write data to a file in a single write, and flush it to storage.
+func writefile(path string, mode int, data []byte) error {
+	f, err := os.OpenFile(path, mode, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Run a conversation file while holding its lock, streaming the reply to
+// w. Once complete, the reply, or its error, is appended to the file, or
+// replaces dst when it names a different file.
+func inplace(ctx context.Context, w io.Writer, path, dst, flags string) error {
+	unlock, err := lockfile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	txt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var reply bytes.Buffer
+	out := io.MultiWriter(w, &reply)
+	qerr := query(ctx, out, path, string(txt), flags)
+	if qerr != nil {
+		writeerror(out, qerr)
+		qerr = Reported{qerr}
+	}
+
+	mode := os.O_WRONLY | os.O_APPEND
+	if dst != path {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	if err := writefile(dst, mode, reply.Bytes()); err != nil {
+		return err
+	}
+	return qerr
+}
+
+// Run many conversation files, at most jobs at a time, and summarize the
+// outcome. Directories contribute their regular, non-hidden files.
+func batch(
+	ctx context.Context, w io.Writer, paths []string, jobs int,
+	suffix, flags string,
+) error {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Mode().IsRegular() || strings.HasPrefix(name, ".") {
+				continue
+			}
+			if suffix != "" && strings.HasSuffix(name, suffix) {
+				continue // output from a previous run
+			}
+			files = append(files, fp.Join(path, name))
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("-batch: no conversation files")
+	}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+	errs := make([]error, len(files))
+	limit := make(chan bool, jobs)
+	var wg sync.WaitGroup
+	for i, file := range files {
+		limit <- true
+		if ctx.Err() != nil {
+			errs[i] = fmt.Errorf("skipped: %w", ctx.Err())
+			<-limit
+			continue
+		}
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			dst := file + suffix
+			errs[i] = inplace(ctx, ioutil.Discard, file, dst, flags)
+			<-limit
+		}(i, file)
+	}
+	wg.Wait()
+
+	nfail := 0
+	b := bufio.NewWriter(w)
+	for i, file := range files {
+		if errs[i] != nil {
+			nfail++
+			fmt.Fprintf(b, "%s: %v\n", file, errs[i])
+		} else {
+			fmt.Fprintf(b, "%s: ok\n", file)
+		}
+	}
+	fmt.Fprintf(b, "%d succeeded, %d failed\n", len(files)-nfail, nfail)
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	if nfail > 0 {
+		return fmt.Errorf("%d of %d conversations failed", nfail, len(files))
+	}
+	return nil
+}
+
+// Report whether a file is a terminal.
+func terminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Read one message from the terminal, continuing onto the next line after
+// a trailing backslash.
+func readmessage(in *bufio.Reader) (string, error) {
+	var lines []string
+	for {
+		line, err := in.ReadString('\n')
+		if err == io.EOF && line == "" && len(lines) == 0 {
+			return "", err
+		} else if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if err == nil && strings.HasSuffix(line, "\\") {
+			lines = append(lines, line[:len(line)-1])
+			fmt.Print(". ")
+			continue
+		}
+		lines = append(lines, line)
+		return strings.Join(lines, "\n"), nil
+	}
+}
+
+// Run an interactive conversation on the terminal. Each message is sent
+// as a user message, and "/NAME ARGS" becomes a "!NAME ARGS" directive
+// for the rest of the conversation. With a file, the conversation picks
+// up from the file, and each exchange is appended to it. An interrupt
+// cancels the reply in progress rather than exiting.
+func repl(path, flags string) error {
+	name := "<terminal>"
+	var transcript bytes.Buffer
+	if path != "" {
+		unlock, err := lockfile(path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		txt, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		transcript.Write(txt)
+		name = path
+	}
+
+	commit := func(txt string) error {
+		transcript.WriteString(txt)
+		if path == "" {
+			return nil
+		}
+		mode := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+		return writefile(path, mode, []byte(txt))
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("\n> ")
+		message, err := readmessage(in)
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		message = strings.TrimSpace(message)
+		switch {
+		case message == "":
+			continue
+
+		case message == "/quit" || message == "/exit":
+			return nil
+
+		case strings.HasPrefix(message, "//"):
+			message = message[1:] // escape "//" as "/"
+
+		case message[0] == '/':
+			// Check the directive before it becomes permanent
+			line := "\n!" + message[1:] + "\n"
+			txt := transcript.String() + line
+			if err := NewChatState().LoadInput(name, txt, flags); err != nil {
+				writeerror(os.Stdout, err)
+			} else if err := commit(line); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-interrupt: // discard interrupts from the prompt
+		default:
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan bool)
+		go func() {
+			select {
+			case <-interrupt:
+				cancel()
+			case <-done:
+			}
+		}()
+
+		turn := "\n\n!user\n\n" + message + "\n"
+		var reply bytes.Buffer
+		out := io.MultiWriter(os.Stdout, &reply)
+		err = query(ctx, out, name, transcript.String()+turn, flags)
+		close(done)
+		cancel()
+
+		if err != nil {
+			writeerror(os.Stdout, err)
+			continue // try again without this message
+		}
+		if err := commit(turn + reply.String()); err != nil {
+			return err
+		}
+	}
+}
+
+// Directives collects command line flags as their equivalent directives,
+// in order, converting each flag value with a format function.
+type Directives struct {
+	Lines  *[]string
+	Format func(string) (string, error)
+}
+
+func (d Directives) String() string {
+	return ""
+}
+
+func (d Directives) Set(value string) error {
+	line, err := d.Format(value)
+	if err != nil {
+		return err
+	}
+	*d.Lines = append(*d.Lines, line)
+	return nil
+}
+
+// Format a flag value as a directive with an argument.
+func directive(command string) func(string) (string, error) {
+	return func(value string) (string, error) {
+		return command + " " + value, nil
+	}
+}
+
+// Convert "KEY=VALUE" into a "!:KEY VALUE" directive.
+func setflag(value string) (string, error) {
+	key, value, ok := cut(value, '=')
+	if !ok || key == "" {
+		return "", fmt.Errorf("expected KEY=VALUE: %s", key)
+	}
+	return "!:" + key + " " + value, nil
+}
+
+// Convert "NAME=VALUE" into a "!set NAME VALUE" directive.
+func varflag(value string) (string, error) {
+	name, value, ok := cut(value, '=')
+	if !ok || !varname(name) {
+		return "", fmt.Errorf("expected NAME=VALUE: %s", name)
+	}
+	return "!set " + name + " " + value, nil
+}
+
+// Convert "NAME: VALUE" into a "!>NAME VALUE" directive.
+func headerflag(value string) (string, error) {
+	key, value, ok := cut(value, ':')
+	key = strings.ToLower(strings.TrimSpace(key))
+	if !ok || key == "" {
+		return "", fmt.Errorf("expected NAME: VALUE: %s", key)
+	}
+	return "!>" + key + " " + strings.TrimSpace(value), nil
+}
+
+func run() error {
+	var profiles, lines []string
+	flag.Var(Directives{&profiles, directive("!profile")}, "profile",
+		"load profile `NAME`, like !profile")
+	flag.Var(Directives{&lines, directive("!api")}, "api",
+		"set the API base `URL`, like !api")
+	flag.Var(Directives{&lines, setflag}, "set",
+		"set a JSON `KEY=VALUE`, like !:KEY VALUE")
+	flag.Var(Directives{&lines, varflag}, "var",
+		"set a template variable `NAME=VALUE`, like !set")
+	flag.Var(Directives{&lines, headerflag}, "header",
+		"set an HTTP header `NAME: VALUE`, like !>NAME VALUE")
+	var (
+		debug = flag.Bool("debug", false,
+			"print the HTTP request instead of sending it, like !debug")
+		explain = flag.Bool("explain", false,
+			"print the effective configuration instead, like !explain")
+		output = flag.String("o", "",
+			"write the reply to `FILE` instead of standard output")
+		appendto = flag.String("append", "",
+			"append the reply to `FILE` instead of standard output")
+		edit = flag.String("i", "",
+			"read the conversation from `FILE` and append the reply to it")
+		session = flag.String("session", "",
+			"in interactive mode, continue and record the conversation in `FILE`")
+		batchmode = flag.Bool("batch", false,
+			"run each FILE argument, or files in a DIR, as a conversation")
+		jobs = flag.Int("j", 4,
+			"maximum concurrent conversations in batch mode")
+		suffix = flag.String("suffix", "",
+			"in batch mode, write replies to FILE+`SUFFIX` instead of appending")
+		list = flag.Bool("list-profiles", false,
+			"list available profiles and where each is found, then exit")
+	)
+	flag.Parse()
+
+	if *list {
+		return listprofiles(os.Stdout)
+	}
+
+	if *debug {
+		lines = append(lines, "!debug")
+	}
+	if *explain {
+		lines = append(lines, "!explain")
+	}
+	// LoadInput loads the profiles ahead of the input, the rest after it
+	flags := strings.Join(append(profiles, lines...), "\n")
+	interactive := terminal(os.Stdin) && terminal(os.Stdout) &&
+		*output == "" && *appendto == "" && *edit == "" && !*batchmode
+
+	// Interrupts and termination cancel queries in progress, which then
+	// complete the transcript. Another signal exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !interactive {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			signal.Stop(signals)
+			cancel()
+		}()
+	}
+
+	if *batchmode {
+		if *output != "" || *appendto != "" || *edit != "" {
+			return fmt.Errorf("-batch: cannot be used with -o, -append, or -i")
+		}
+		return batch(ctx, os.Stdout, flag.Args(), *jobs, *suffix, flags)
+	} else if flag.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", flag.Arg(0))
+	}
+
+	if *session != "" && !interactive {
+		return fmt.Errorf("-session: requires a terminal")
+	}
+	if interactive {
+		return repl(*session, flags)
+	}
+
+	var out io.Writer = os.Stdout
+	switch {
+	case *output != "" && *appendto != "":
+		return fmt.Errorf("-o: cannot be used with -append")
+	case *output != "":
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	case *appendto != "":
+		mode := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+		f, err := os.OpenFile(*appendto, mode, 0666)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if *edit != "" {
+		return inplace(ctx, out, *edit, *edit, flags)
+	}
+
+	body, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	err = query(ctx, out, "<stdin>", string(body), flags)
+	if err != nil {
+		writeerror(out, err)
+		return Reported{err}
+	}
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		if _, ok := err.(Reported); !ok {
+			writeerror(os.Stdout, err)
+		}
 		os.Exit(1)
 	}
 }
@@ -15,10 +15,21 @@ function! IllumeAppend(channel, msg)
 endfunction
 
 function! IllumeStop()
-    try
-        call job_stop(b:illume_job)
-    catch
-    endtry
+    let job = get(b:, 'illume_job', v:null)
+    if type(job) == v:t_job && job_status(job) ==# 'run'
+        " Let it finish the transcript before anything else writes to
+        " the buffer, but do not wait forever.
+        call job_stop(job)
+        let start = reltime()
+        while (job_status(job) ==# 'run' ||
+            \ ch_status(job_getchannel(job)) !=# 'closed') &&
+            \ reltimefloat(reltime(start)) < 5
+            sleep 10m
+        endwhile
+        if job_status(job) ==# 'run'
+            call job_stop(job, 'kill')
+        endif
+    endif
     let b:illume_job = v:null
 endfunction
 
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})
+	if err := ioutil.WriteFile(ca, cert, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		directives string
+		ok         bool
+	}{
+		{"trusted", "!tls-ca " + ca, true},
+		{"untrusted", "", false},
+		{"insecure", "!tls-insecure", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewChatState()
+			if err := s.Load("test", test.directives, 0); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := s.client("").Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if test.ok && err != nil {
+				t.Errorf("want success, got %v", err)
+			} else if !test.ok && err == nil {
+				t.Errorf("want certificate error, got success")
+			}
+		})
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	settings := []struct {
+		name string
+		low  string
+		high string
+		get  func(*ChatState) interface{}
+		want interface{}
+	}{
+		{
+			"api", "!api http://low/", "!api http://high/",
+			func(s *ChatState) interface{} { return s.Api },
+			"http://high/",
+		},
+		{
+			"header", "!>X-Test low", "!>x-test high",
+			func(s *ChatState) interface{} { return s.Headers["x-test"] },
+			"high",
+		},
+		{
+			"prepend", "!prepend low", "!prepend high",
+			func(s *ChatState) interface{} { return s.Prepend },
+			"high",
+		},
+		{
+			"exclude", "!exclude low", "!exclude high",
+			func(s *ChatState) interface{} { return s.Exclude },
+			"high",
+		},
+		{
+			"fim", "!infill low{prefix}", "!infill high{prefix}",
+			func(s *ChatState) interface{} { return s.FimTmpl },
+			"high{prefix}",
+		},
+		{
+			"set", "!set name low", "!set name high",
+			func(s *ChatState) interface{} { return s.Vars["name"] },
+			"high",
+		},
+		{
+			"proxy", "!proxy http://low:3128", "!proxy http://high:3128",
+			func(s *ChatState) interface{} {
+				u, _ := s.Proxy(&http.Request{})
+				return u.Host
+			},
+			"high:3128",
+		},
+		{
+			"key", "!:options.num_ctx 1024", "!:options.num_ctx 8192",
+			func(s *ChatState) interface{} {
+				v, _ := lookup(s.Data, "options.num_ctx")
+				return v
+			},
+			8192.0,
+		},
+		{
+			"object", `!:options {"num_ctx": 1024}`, "!:options.num_ctx 8192",
+			func(s *ChatState) interface{} {
+				v, _ := lookup(s.Data, "options.num_ctx")
+				return v
+			},
+			8192.0,
+		},
+	}
+
+	// Layers from lowest to highest. The lower layer is always loaded
+	// after the higher one, except for flags, so order cannot decide.
+	layers := []string{"env", "profile", "input", "flags"}
+
+	dir := t.TempDir()
+	for _, setting := range settings {
+		for i, low := range layers {
+			for _, high := range layers[i+1:] {
+				name := fmt.Sprintf("%s/%s<%s", setting.name, low, high)
+				file := fmt.Sprintf("%s-%s-%s", setting.name, low, high)
+				t.Run(name, func(t *testing.T) {
+					lines := map[string][]string{
+						low:  {setting.low},
+						high: {setting.high},
+					}
+
+					env := filepath.Join(dir, file+".env")
+					profile := filepath.Join(dir, file+".profile")
+					writelines(t, env, lines["env"])
+					writelines(t, profile, lines["profile"])
+					t.Setenv("ILLUME_PROFILE", env)
+
+					input := append(lines["input"], "!profile "+profile)
+					flags := strings.Join(lines["flags"], "\n")
+
+					s := NewChatState()
+					text := strings.Join(input, "\n")
+					if err := s.LoadInput("input", text, flags); err != nil {
+						t.Fatal(err)
+					}
+					if err := s.LoadDefaultProfile(); err != nil {
+						t.Fatal(err)
+					}
+					if got := setting.get(s); got != setting.want {
+						t.Errorf("got %#v, want %#v", got, setting.want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		flags string
+		want  string
+	}{
+		{"extend", `!:stop+ "b"`, "", `["a","b"]`},
+		{"replace", `!:stop ["c"]`, "", `["c"]`},
+		{"then replace", "!:stop+ \"b\"\n!:stop [\"c\"]", "", `["c"]`},
+		{"flags", `!:stop ["c"]`, `!:stop+ "b"`, `["c","b"]`},
+	}
+
+	profile := filepath.Join(t.TempDir(), "stop.profile")
+	writelines(t, profile, []string{`!:stop ["a"]`})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewChatState()
+			input := test.input + "\n!profile " + profile
+			if err := s.LoadInput("input", input, test.flags); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.Request(); err != nil {
+				t.Fatal(err)
+			}
+			buf, _ := marshal(s.Data["stop"])
+			if got := strings.TrimSpace(string(buf)); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func writelines(t *testing.T, path string, lines []string) {
+	t.Helper()
+	buf := []byte(strings.Join(lines, "\n"))
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompareEndpoints(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.profile")
+	b := filepath.Join(dir, "b.profile")
+	writelines(t, a, []string{"!api http://a/", "!>authorization Bearer akey"})
+	writelines(t, b, []string{"!api http://b/"})
+
+	txt := "!api http://input/\n!>x-test input\n!compare " + a + " " + b +
+		"\n!explain\n!user\nhi\n"
+	var buf bytes.Buffer
+	flags := "!api http://flag/"
+	profiles := []string{a, b}
+	err := compare(context.Background(), &buf, "input", txt, flags, profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"api: http://a/chat/completions (" + a + ":1)",
+		"api: http://b/chat/completions (" + b + ":1)",
+		"(" + a + ":2)", // authorization
+		"header x-test: input (input:2)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"http://input/", "http://flag/"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("request sent to %s:\n%s", unwanted, out)
+		}
+	}
+	if strings.Count(out, "authorization") != 1 {
+		t.Errorf("credentials of %s reached %s:\n%s", a, b, out)
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	host, _ := os.Hostname()
+
+	// A process that has come and gone
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe, "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead := cmd.Process.Pid
+
+	var fresh time.Time
+	old := time.Now().Add(-2 * time.Minute)
+	tests := []struct {
+		name    string
+		content string
+		mtime   time.Time
+		stale   bool
+	}{
+		{"live", fmt.Sprintf("%d %s\n", os.Getpid(), host), fresh, false},
+		{"dead", fmt.Sprintf("%d %s\n", dead, host), fresh, true},
+		{"dead without host", fmt.Sprintf("%d\n", dead), fresh, true},
+		{"remote", fmt.Sprintf("%d %s.invalid\n", dead, host), fresh, false},
+		{"empty", "", fresh, false},
+		{"empty and old", "", old, true},
+	}
+	dir := t.TempDir()
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lock := filepath.Join(dir, fmt.Sprintf("%d.lock", i))
+			err := ioutil.WriteFile(lock, []byte(test.content), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.mtime != fresh {
+				os.Chtimes(lock, test.mtime, test.mtime)
+			}
+			if got := stalelock(lock, host); got != test.stale {
+				t.Errorf("got %v, want %v", got, test.stale)
+			}
+		})
+	}
+
+	if stalelock(filepath.Join(dir, "missing.lock"), host) {
+		t.Errorf("missing lock reported stale")
+	}
+
+	// Take over a stale lock once, then hold it
+	path := filepath.Join(dir, "chat.md")
+	stale := fmt.Sprintf("%d %s\n", dead, host)
+	if err := ioutil.WriteFile(path+".lock", []byte(stale), 0666); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockfile(path)
+	if err != nil {
+		t.Fatalf("stale lock not taken over: %v", err)
+	}
+	if _, err := lockfile(path); err == nil {
+		t.Errorf("held lock taken over")
+	}
+	if _, err := os.Stat(path + ".lock.takeover"); !os.IsNotExist(err) {
+		t.Errorf("takeover guard left behind")
+	}
+	unlock()
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock left behind after unlock")
+	}
+}
+
+func TestSecretCommand(t *testing.T) {
+	profile := filepath.Join(t.TempDir(), "secret.profile")
+	writelines(t, profile, []string{"!secret-command echo {name}"})
+
+	s := NewChatState()
+	if err := s.LoadInput("input", "!profile "+profile, ""); err != nil {
+		t.Fatal(err)
+	}
+	if s.SecretCmd != "echo {name}" {
+		t.Errorf("profile: got %q", s.SecretCmd)
+	}
+
+	s = NewChatState()
+	err := s.LoadInput("input", "!secret-command echo {name}", "")
+	if err == nil || s.SecretCmd != "" {
+		t.Errorf("input: accepted %q", s.SecretCmd)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		want   []string
+	}{
+		{"integer", `{"type": "integer"}`, `3`, nil},
+		{"not integer", `{"type": "integer"}`, `3.5`,
+			[]string{"$: expected integer, got number"}},
+		{"integer as number", `{"type": "number"}`, `3`, nil},
+		{"type list", `{"type": ["string", "null"]}`, `null`, nil},
+		{"type mismatch", `{"type": "object"}`, `[]`,
+			[]string{"$: expected object, got array"}},
+		{"required", `{"required": ["a", "b"]}`, `{"a": 1}`,
+			[]string{`$: missing required property "b"`}},
+		{
+			"nested",
+			`{"properties": {"a": {"type": "string"}}}`,
+			`{"a": 1}`,
+			[]string{"$.a: expected string, got integer"},
+		},
+		{
+			"no additional",
+			`{"properties": {"a": {}}, "additionalProperties": false}`,
+			`{"a": 1, "b": 2}`,
+			[]string{"$.b: unexpected property"},
+		},
+		{
+			"additional schema",
+			`{"additionalProperties": {"type": "string"}}`,
+			`{"a": "x", "b": 2}`,
+			[]string{"$.b: expected string, got integer"},
+		},
+		{
+			"ref",
+			`{"$defs": {"n": {"type": "number"}},
+			  "items": {"$ref": "#/$defs/n"}}`,
+			`[1, "x"]`,
+			[]string{"$[1]: expected number, got string"},
+		},
+		{
+			"escaped ref",
+			`{"$defs": {"a/b": {"const": 1}}, "$ref": "#/$defs/a~1b"}`,
+			`1`,
+			nil,
+		},
+		{"unresolved ref", `{"$ref": "#/$defs/missing"}`, `1`,
+			[]string{"$: unresolved $ref: #/$defs/missing"}},
+		{"remote ref", `{"$ref": "other.json"}`, `1`,
+			[]string{"$: unsupported $ref: other.json"}},
+		{"anyOf", `{"anyOf": [{"type": "string"}, {"minimum": 5}]}`, `7`, nil},
+		{"anyOf none", `{"anyOf": [{"type": "string"}, {"minimum": 5}]}`, `1`,
+			[]string{"$: matches none of anyOf"}},
+		{"oneOf", `{"oneOf": [{"type": "integer"}, {"type": "string"}]}`, `1`,
+			nil},
+		{"oneOf many", `{"oneOf": [{"type": "integer"}, {"minimum": 0}]}`, `1`,
+			[]string{"$: matches more than one of oneOf"}},
+		{"enum", `{"enum": ["a", "b"]}`, `"c"`,
+			[]string{"$: not one of the allowed values"}},
+		{"false", `{"items": false}`, `[1]`, []string{"$[0]: not allowed"}},
+		{"bounds", `{"minItems": 2, "items": {"maxLength": 1}}`, `["ab"]`,
+			[]string{
+				"$: fewer than 2 items",
+				"$[0]: longer than 1 characters",
+			}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var schema, value interface{}
+			if err := json.Unmarshal([]byte(test.schema), &schema); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.value), &value); err != nil {
+				t.Fatal(err)
+			}
+			var errs []string
+			validate(schema, schema, value, "$", &errs)
+			if !reflect.DeepEqual(errs, test.want) {
+				t.Errorf("got %q, want %q", errs, test.want)
+			}
+		})
+	}
+}
+
+func TestConforms(t *testing.T) {
+	s := NewChatState()
+	s.Schema = map[string]interface{}{"type": "object"}
+	if err := s.conforms([]byte("<think>hmm</think>\n{}")); err != nil {
+		t.Errorf("reasoning before JSON: %v", err)
+	}
+	if err := s.conforms([]byte("Sure! {}")); err == nil {
+		t.Errorf("accepted a reply that is not JSON")
+	}
+	if err := s.conforms([]byte("[]")); err == nil {
+		t.Errorf("accepted a reply of the wrong type")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		secrets map[string]string
+		raw     bool
+		text    string
+		want    string
+	}{
+		{
+			"header", map[string]string{"x-api-key": "hunter2hunter2"}, nil,
+			false, "x-api-key: hunter2hunter2", "x-api-key: [redacted]",
+		},
+		{
+			"scheme kept",
+			map[string]string{"Authorization": "Bearer abcdefgh"}, nil,
+			false, "Bearer abcdefgh", "Bearer [redacted]",
+		},
+		{
+			"other header", map[string]string{"x-test": "hunter2hunter2"}, nil,
+			false, "hunter2hunter2", "hunter2hunter2",
+		},
+		{
+			"token", nil, nil,
+			false, `"key": "sk-abcdefghijklmnopqrstu"`, `"key": "[redacted]"`,
+		},
+		{
+			"bearer", nil, nil,
+			false, "401: bearer abcdefghijklmnopq", "401: bearer [redacted]",
+		},
+		{
+			"secret", nil, map[string]string{"openai": "s3cr3t-value"},
+			false, "Bearer s3cr3t-value", "Bearer {secret:openai}",
+		},
+		{
+			"raw", map[string]string{"x-api-key": "hunter2hunter2"},
+			map[string]string{"openai": "s3cr3t-value"},
+			true, "hunter2hunter2 s3cr3t-value sk-abcdefghijklmnopqrstu",
+			"hunter2hunter2 s3cr3t-value sk-abcdefghijklmnopqrstu",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewChatState()
+			for key, value := range test.headers {
+				s.Headers[key] = value
+			}
+			s.Secrets = test.secrets
+			s.Raw = test.raw
+			if got := s.redact(test.text); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// "!debug raw" is the directive that opts out
+	s := NewChatState()
+	if err := s.Load("test", "!debug raw", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Raw {
+		t.Errorf("!debug raw did not disable redaction")
+	}
+}
+
+// Describe the messages loaded so far, one "role: content" per message.
+func transcript(s *ChatState) string {
+	var lines []string
+	for _, m := range s.Builder.New("") {
+		lines = append(lines, m.Role+": "+m.Content)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestHeredoc(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		prepend string
+		want    string
+		err     string
+	}{
+		{
+			name:    "value",
+			input:   "!prepend <<EOF\nSure!\n  Here:\nEOF\n!user\nhi",
+			prepend: "Sure!\n  Here:",
+			want:    "user: hi",
+		},
+		{
+			name:  "line numbers after",
+			input: "!:stop <<EOF\n[\"a\"]\nEOF\n!samples x",
+			err:   `test:4: !samples: invalid count: "x"`,
+		},
+		{
+			name:  "missing terminator",
+			input: "!user\nhi\n!prepend <<EOF\nSure!",
+			err:   "test:3: !prepend: missing EOF terminator",
+		},
+		{
+			name: "inactive",
+			input: "!if var:no\n!prepend <<EOF\n!endif\nEOF\n!endif\n" +
+				"!user\nhi",
+			prepend: "",
+			want:    "user: hi",
+		},
+		{
+			name:  "plain text",
+			input: "!user <<EOF\nhi\n!shell <<EOF\nEOF",
+			want:  "user: hi\n!shell <<EOF\nEOF",
+		},
+		{
+			name:  "excluded",
+			input: "!exclude x\n<x>\n!prepend <<EOF\n</x>\nEOF\n!user\nhi",
+			want:  "system: EOF\nuser: hi",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewChatState()
+			err := s.Load("test", test.input, 0)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if s.Prepend != test.prepend {
+				t.Errorf("prepend: got %q, want %q", s.Prepend, test.prepend)
+			}
+			if got := transcript(s); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConditional(t *testing.T) {
+	t.Setenv("ILLUME_TEST", "on")
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		err   string
+	}{
+		{
+			name:  "else",
+			input: "!set a 1\n!if var:a\nyes\n!else\nno\n!endif",
+			want:  "system: yes",
+		},
+		{
+			name:  "negated",
+			input: "!if !var:a\nyes\n!else\nno\n!endif",
+			want:  "system: yes",
+		},
+		{
+			name: "equality",
+			input: "!:model big\n!if key:model=small\nsmall\n!endif\n" +
+				"!if env:ILLUME_TEST=on\non\n!endif",
+			want: "system: on",
+		},
+		{
+			name: "nested",
+			input: "!if env:ILLUME_TEST\na\n!if var:b\nb\n!else\nc\n" +
+				"!endif\nd\n!else\n!if env:ILLUME_TEST\ne\n!endif\n!endif",
+			want: "system: a\nc\nd",
+		},
+		{
+			name:  "profile",
+			input: "!profile llama.cpp\n!if profile:llama.cpp\nyes\n!endif",
+			want:  "system: yes",
+		},
+		{
+			name:  "missing endif",
+			input: "!if var:a\n!if var:b\n!endif\ntext",
+			err:   "test:1: !if: missing !endif",
+		},
+		{
+			name:  "missing inner endif",
+			input: "!if var:a\n!endif\n!if var:b\n!if var:c\n!endif",
+			err:   "test:3: !if: missing !endif",
+		},
+		{
+			name:  "stray else",
+			input: "text\n!else",
+			err:   "test:2: !else: no matching !if",
+		},
+		{
+			name:  "second else",
+			input: "!if var:a\n!else\n!else\n!endif",
+			err:   "test:3: !else: no matching !if",
+		},
+		{
+			name:  "stray endif",
+			input: "!if var:a\n!endif\n!endif",
+			err:   "test:3: !endif: no matching !if",
+		},
+		{
+			name:  "unknown condition",
+			input: "\n!if bogus:a\n!endif",
+			err:   `test:2: !if: unknown condition: "bogus:a"`,
+		},
+		{
+			name:  "inactive unknown condition",
+			input: "!if var:a\n!if bogus:a\n!endif\n!endif",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewChatState()
+			err := s.Load("test", test.input, 0)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := transcript(s); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	t.Setenv("ILLUME_TEST", "env")
+	tests := []struct {
+		name  string
+		input string
+		flags string
+		want  string
+	}{
+		{"variable", "!set a A\n!user\n{{a}} and {{ a }}", "", "user: A and A"},
+		{"flag", "!set a A\n!user\n{{a}}", "!set a F", "user: F"},
+		{"env", "!user\n{{env:ILLUME_TEST}}", "", "user: env"},
+		{"no bare env", "!user\n{{ILLUME_TEST}}", "", "user: {{ILLUME_TEST}}"},
+		{"unknown", "!user\n{{nope}} {{env:NOPE_X}}", "",
+			"user: {{nope}} {{env:NOPE_X}}"},
+		{"escaped", "!set a A\n!user\n\\{{a}} {{a}}", "", "user: {{a}} A"},
+		{"unclosed", "!set a A\n!user\n{{a}} {{a", "", "user: A {{a"},
+		{"invalid name", "!set a A\n!user\n{{a b}}", "", "user: {{a b}}"},
+		{"system", "!set a A\nBe {{a}}.", "", "system: Be A."},
+		{"assistant", "!set a A\n!user\nhi\n!assistant\n{{a}}", "",
+			"user: hi\nassistant: {{a}}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewChatState()
+			if err := s.LoadInput("test", test.input, test.flags); err != nil {
+				t.Fatal(err)
+			}
+			if got := transcript(s); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}